@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"log"
 	"net/textproto"
 	"strings"
 	"time"
@@ -12,38 +11,20 @@ import (
 
 // AddressList parses the named header field as a list of addresses.
 func AddressList(header textproto.MIMEHeader, key string, utf8ReaderFactory UTF8ReaderFactory) (r []*Address, err error) {
-	// h := make(map[string][]string)
-
-	// vals := header[key]
-	// if vals == nil {
-	// 	return
-	// }
-	// var newDecodedVals []string
-	// for _, val := range vals {
-	// 	var newVal string
-	// 	newVal, err = DecodeText(val, utf8ReaderFactory)
-	// 	if err != nil {
-	// 		return
-	// 	}
-	// 	newDecodedVals = append(newDecodedVals, newVal)
-	// }
-	// h[key] = newDecodedVals
+	return AddressListWithOptions(header, key, &DecodeOptions{UTF8ReaderFactory: utf8ReaderFactory})
+}
+
+// AddressListWithOptions is like AddressList, raw 8-bit text in the field
+// is converted to UTF-8 as configured by opts before it is parsed. Only
+// with a FallbackCharset or DetectCharset are UTF-8 characters accepted in
+// atoms and quoted-strings, as RFC 6532 allows.
+func AddressListWithOptions(header textproto.MIMEHeader, key string, opts *DecodeOptions) (r []*Address, err error) {
 	hdr := header.Get(key)
 	if hdr == "" {
 		return nil, ErrHeaderNotPresent
 	}
 
-	return newAddrParser(hdr, utf8ReaderFactory).parseAddressList()
-}
-
-var debug = debugT(false)
-
-type debugT bool
-
-func (d debugT) Printf(format string, args ...interface{}) {
-	if d {
-		log.Printf(format, args...)
-	}
+	return newAddrParser(string(opts.decode8bit([]byte(hdr))), opts).parseAddressList()
 }
 
 // Layouts suitable for passing to time.Parse.
@@ -150,12 +131,14 @@ func (a *Address) String() string {
 }
 
 type addrParser struct {
-	content           []byte
-	utf8ReaderFactory UTF8ReaderFactory
+	content []byte
+	opts    *DecodeOptions
+	utf8    bool // UTF-8 characters are atext and qtext
 }
 
-func newAddrParser(s string, utf8ReaderFactory UTF8ReaderFactory) *addrParser {
-	p := addrParser{[]byte(s), utf8ReaderFactory}
+func newAddrParser(s string, opts *DecodeOptions) *addrParser {
+	utf8 := opts != nil && (opts.FallbackCharset != "" || opts.DetectCharset)
+	p := addrParser{[]byte(s), opts, utf8}
 	return &p
 }
 
@@ -182,7 +165,6 @@ func (p *addrParser) parseAddressList() ([]*Address, error) {
 
 // parseAddress parses a single RFC 5322 address at the start of p.
 func (p *addrParser) parseAddress() (addr *Address, err error) {
-	debug.Printf("parseAddress: %q", p.content)
 	p.skipSpace()
 	if p.empty() {
 		return nil, errors.New("mail: no address")
@@ -201,8 +183,6 @@ func (p *addrParser) parseAddress() (addr *Address, err error) {
 			Address: spec,
 		}, err
 	}
-	debug.Printf("parseAddress: not an addr-spec: %v", err)
-	debug.Printf("parseAddress: state is now %q", *p)
 
 	// display-name
 	var displayName string
@@ -212,7 +192,6 @@ func (p *addrParser) parseAddress() (addr *Address, err error) {
 			return nil, err
 		}
 	}
-	debug.Printf("parseAddress: displayName=%q", displayName)
 
 	// angle-addr = "<" addr-spec ">"
 	p.skipSpace()
@@ -226,7 +205,6 @@ func (p *addrParser) parseAddress() (addr *Address, err error) {
 	if !p.consume('>') {
 		return nil, errors.New("mail: unclosed angle-addr")
 	}
-	debug.Printf("parseAddress: spec=%q", spec)
 
 	return &Address{
 		Name:    displayName,
@@ -236,8 +214,6 @@ func (p *addrParser) parseAddress() (addr *Address, err error) {
 
 // consumeAddrSpec parses a single RFC 5322 addr-spec at the start of p.
 func (p *addrParser) consumeAddrSpec() (spec string, err error) {
-	debug.Printf("consumeAddrSpec: %q", *p)
-
 	orig := *p
 	defer func() {
 		if err != nil {
@@ -253,15 +229,12 @@ func (p *addrParser) consumeAddrSpec() (spec string, err error) {
 	}
 	if p.peek() == '"' {
 		// quoted-string
-		debug.Printf("consumeAddrSpec: parsing quoted-string")
 		localPart, err = p.consumeQuotedString()
 	} else {
 		// dot-atom
-		debug.Printf("consumeAddrSpec: parsing dot-atom")
 		localPart, err = p.consumeAtom(true)
 	}
 	if err != nil {
-		debug.Printf("consumeAddrSpec: failed: %v", err)
 		return "", err
 	}
 
@@ -284,11 +257,27 @@ func (p *addrParser) consumeAddrSpec() (spec string, err error) {
 	return localPart + "@" + domain, nil
 }
 
-// consumePhrase parses the RFC 5322 phrase at the start of p.
+// consumePhrase parses the RFC 5322 phrase at the start of p. Runs of
+// adjacent encoded-words are decoded together, so that the whitespace
+// between them is dropped and characters split across them are joined,
+// RFC 2047 section 6.2.
 func (p *addrParser) consumePhrase() (phrase string, err error) {
-	debug.Printf("consumePhrase: [%s]", *p)
 	// phrase = 1*word
 	var words []string
+	var run []string
+	decodeRun := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		decoded, err := DecodeTextWithOptions(strings.Join(run, " "), p.opts)
+		run = run[:0]
+		if err != nil {
+			return err
+		}
+		words = append(words, decoded)
+		return nil
+	}
+
 	for {
 		// word = atom / quoted-string
 		var word string
@@ -296,28 +285,36 @@ func (p *addrParser) consumePhrase() (phrase string, err error) {
 		if p.empty() {
 			return "", errors.New("mail: missing phrase")
 		}
-		if p.peek() == '"' {
+		quoted := p.peek() == '"'
+		if quoted {
 			// quoted-string
 			word, err = p.consumeQuotedString()
 		} else {
 			// atom
 			word, err = p.consumeAtom(false)
 		}
+		if err != nil {
+			break
+		}
 
 		// RFC 2047 encoded-word starts with =?, ends with ?=, and has two other ?s.
-		if err == nil && strings.HasPrefix(word, "=?") && strings.HasSuffix(word, "?=") && strings.Count(word, "?") == 4 {
-			word, err = DecodeText(word, p.utf8ReaderFactory)
+		if strings.HasPrefix(word, "=?") && strings.HasSuffix(word, "?=") && strings.Count(word, "?") == 4 {
+			if quoted {
+				report(p.opts.diagnostics(), EncodedWordInQuotedString, word, "", nil)
+			}
+			run = append(run, word)
+			continue
 		}
-
-		if err != nil {
+		if err = decodeRun(); err != nil {
 			break
 		}
-		debug.Printf("consumePhrase: consumed %q", word)
 		words = append(words, word)
 	}
+	if derr := decodeRun(); derr != nil {
+		err = derr
+	}
 	// Ignore any error if we got at least one word.
 	if err != nil && len(words) == 0 {
-		debug.Printf("consumePhrase: hit err: %v", err)
 		return "", errors.New("mail: missing word in phrase")
 	}
 	phrase = strings.Join(words, " ")
@@ -343,7 +340,7 @@ Loop:
 			}
 			qsb = append(qsb, (p.content)[i+1])
 			i += 2
-		case isQtext(c), c == ' ' || c == '\t':
+		case p.isQtext(c), c == ' ' || c == '\t':
 			// qtext (printable US-ASCII excluding " and \), or
 			// FWS (almost; we're ignoring CRLF)
 			qsb = append(qsb, c)
@@ -359,11 +356,11 @@ Loop:
 // consumeAtom parses an RFC 5322 atom at the start of p.
 // If dot is true, consumeAtom parses an RFC 5322 dot-atom instead.
 func (p *addrParser) consumeAtom(dot bool) (atom string, err error) {
-	if !isAtext(p.peek(), false) {
+	if !p.isAtext(p.peek(), false) {
 		return "", errors.New("mail: invalid string")
 	}
 	i := 1
-	for ; i < p.len() && isAtext(p.content[i], dot); i++ {
+	for ; i < p.len() && p.isAtext(p.content[i], dot); i++ {
 	}
 	atom, p.content = string(p.content[:i]), p.content[i:]
 	return atom, nil
@@ -394,6 +391,18 @@ func (p *addrParser) len() int {
 	return len(p.content)
 }
 
+// isAtext is isAtext, and also accepts the bytes of UTF-8 characters if
+// p.utf8.
+func (p *addrParser) isAtext(c byte, dot bool) bool {
+	return isAtext(c, dot) || p.utf8 && c >= 0x80
+}
+
+// isQtext is isQtext, and also accepts the bytes of UTF-8 characters if
+// p.utf8.
+func (p *addrParser) isQtext(c byte) bool {
+	return isQtext(c) || p.utf8 && c >= 0x80
+}
+
 var atextChars = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
 	"abcdefghijklmnopqrstuvwxyz" +
 	"0123456789" +
@@ -0,0 +1,316 @@
+package mimemail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+const base64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+var base64Values [256]byte
+
+func init() {
+	for i := range base64Values {
+		base64Values[i] = 0xff
+	}
+	for i := 0; i < len(base64Alphabet); i++ {
+		base64Values[base64Alphabet[i]] = byte(i)
+	}
+}
+
+// Base64Decoder decodes base64 bodies, RFC 2045 section 6.8. By default it
+// is lenient: characters outside the alphabet are skipped, missing or extra
+// padding is accepted, and the text after the padding or after a blank line
+// that ends the data, like a signature appended by a virus scanner, is
+// ignored. A blank line only ends the data when the line after it is not
+// base64, data split by blank lines is decoded whole. Ignored counts the
+// bytes that were skipped, not counting line breaks and other whitespace.
+type Base64Decoder struct {
+	r       io.Reader
+	in      []byte
+	out     []byte
+	outPos  int
+	err     error
+	quantum [4]byte
+	nq      int
+	offset  int64 // of the next input byte
+	done    bool  // the end of the data was seen
+	padding int   // "=" still expected after the end
+	data    bool  // some data was seen
+	blank   bool  // the current line is blank so far
+	paused  bool  // a blank line after the data, held is the line after it
+	held    []byte
+
+	// Strict fails with a base64.CorruptInputError on anything RFC 2045
+	// does not allow, instead of skipping it.
+	Strict      bool
+	Ignored     int64
+	Diagnostics Diagnostics // Receives the first problem worked around
+	reported    bool
+}
+
+func NewBase64Decoder(r io.Reader) *Base64Decoder {
+	return &Base64Decoder{r: r, blank: true}
+}
+
+func (bd *Base64Decoder) Read(p []byte) (n int, err error) {
+	for {
+		if bd.outPos < len(bd.out) {
+			n = copy(p, bd.out[bd.outPos:])
+			bd.outPos += n
+			return
+		}
+		if bd.err != nil {
+			return 0, bd.err
+		}
+		bd.fill()
+	}
+}
+
+// WriteTo writes each decoded piece of input to w.
+func (bd *Base64Decoder) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if bd.outPos < len(bd.out) {
+			m, werr := w.Write(bd.out[bd.outPos:])
+			n += int64(m)
+			bd.outPos += m
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if bd.err != nil {
+			if bd.err != io.EOF {
+				err = bd.err
+			}
+			return
+		}
+		bd.fill()
+	}
+}
+
+// base64ReadSize is how much Base64Decoder reads at a time.
+const base64ReadSize = 3072
+
+// fill reads and decodes the next piece of input into bd.out.
+func (bd *Base64Decoder) fill() {
+	if bd.in == nil {
+		buf := make([]byte, base64ReadSize+base64ReadSize/4*3+3)
+		bd.in, bd.out = buf[:base64ReadSize:base64ReadSize], buf[base64ReadSize:base64ReadSize]
+	}
+	bd.out, bd.outPos = bd.out[:0], 0
+
+	var m int
+	m, bd.err = bd.r.Read(bd.in)
+	if err := bd.decode(bd.in[:m]); err != nil {
+		bd.err = err
+		return
+	}
+	if bd.err == io.EOF {
+		if err := bd.finish(); err != nil {
+			bd.err = err
+		}
+	}
+}
+
+// decodeAll decodes the whole of in, reusing bd for another text.
+func (bd *Base64Decoder) decodeAll(in []byte) (out []byte, err error) {
+	*bd = Base64Decoder{out: bd.out[:0], held: bd.held[:0], blank: true, Diagnostics: bd.Diagnostics}
+	if err = bd.decode(in); err == nil {
+		err = bd.finish()
+	}
+	return bd.out, err
+}
+
+func (bd *Base64Decoder) decode(in []byte) (err error) {
+	for i := 0; i < len(in); i++ {
+		// whole quanta are decoded at once
+		if bd.nq == 0 && !bd.done && !bd.paused && i+4 <= len(in) {
+			v0, v1, v2, v3 := base64Values[in[i]], base64Values[in[i+1]], base64Values[in[i+2]], base64Values[in[i+3]]
+			if (v0|v1|v2|v3)&0xc0 == 0 {
+				bd.out = append(bd.out, v0<<2|v1>>4, v1<<4|v2>>2, v2<<6|v3)
+				bd.offset += 4
+				bd.data, bd.blank = true, false
+				i += 3
+				continue
+			}
+		}
+
+		c := in[i]
+		offset := bd.offset
+		bd.offset++
+
+		if bd.paused {
+			bd.hold(c)
+			continue
+		}
+		if c == '\n' {
+			if bd.blank && bd.data && bd.nq == 0 && !bd.done && !bd.Strict {
+				// a blank line after the data, which may go on after it
+				bd.paused = true
+			}
+			bd.blank = true
+			continue
+		}
+		if isWhitespace(c) {
+			continue
+		}
+		bd.blank = false
+
+		if bd.done {
+			if c == '=' && bd.padding > 0 {
+				bd.padding--
+				continue
+			}
+			if bd.Strict {
+				return base64.CorruptInputError(offset)
+			}
+			if c != '=' {
+				bd.ignore(1, nil)
+			}
+			continue
+		}
+
+		if c == '=' {
+			switch bd.nq {
+			case 2, 3:
+				bd.padding = 3 - bd.nq
+				bd.flush()
+				bd.done = true
+			case 0:
+				if bd.Strict {
+					return base64.CorruptInputError(offset)
+				}
+				// extra padding
+			case 1:
+				if bd.Strict {
+					return base64.CorruptInputError(offset)
+				}
+				bd.nq = 0
+				bd.ignore(1, nil)
+			}
+			continue
+		}
+
+		v := base64Values[c]
+		if v == 0xff {
+			if bd.Strict {
+				return base64.CorruptInputError(offset)
+			}
+			bd.ignore(1, nil)
+			continue
+		}
+		bd.data = true
+		bd.quantum[bd.nq] = v
+		bd.nq++
+		if bd.nq == 4 {
+			bd.flush()
+		}
+	}
+	return
+}
+
+// maxBase64Held bounds the line after a blank line that is held back.
+const maxBase64Held = 1024
+
+// hold collects the line after a blank line, until it is known whether it
+// is base64.
+func (bd *Base64Decoder) hold(c byte) {
+	switch {
+	case c == '\n':
+		if len(bd.held) > 0 {
+			bd.resume()
+			bd.blank = true
+		}
+	case c == '\r':
+	case c == '=' || base64Values[c] != 0xff:
+		bd.held = append(bd.held, c)
+		if len(bd.held) > maxBase64Held {
+			bd.resume()
+		}
+	case isWhitespace(c):
+		if len(bd.held) > 0 {
+			bd.resume()
+		}
+	default:
+		bd.held = append(bd.held, c)
+		bd.resume()
+	}
+}
+
+// resume decodes the held line if it is a line of base64 quanta, or else
+// ends the data there.
+func (bd *Base64Decoder) resume() {
+	line := bd.held
+	bd.paused = false
+	if isBase64Line(line) {
+		offset := bd.offset
+		bd.decode(line)
+		bd.offset = offset
+	} else {
+		bd.done = true
+		bd.ignore(int64(len(line)-bytes.Count(line, []byte("="))), errors.New("mail: text after a blank line in base64 ignored"))
+	}
+	bd.held = bd.held[:0]
+}
+
+// isBase64Line reports whether line is whole quanta of base64.
+func isBase64Line(line []byte) bool {
+	data := bytes.TrimRight(line, "=")
+	if len(data) == 0 || len(line)-len(data) > 2 || len(line)%4 != 0 {
+		return false
+	}
+	for _, c := range data {
+		if base64Values[c] == 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// finish decodes an incomplete quantum at the end of the input.
+func (bd *Base64Decoder) finish() (err error) {
+	if bd.paused && len(bd.held) > 0 {
+		bd.resume()
+	}
+	if bd.Strict && bd.padding > 0 {
+		return base64.CorruptInputError(bd.offset)
+	}
+	if bd.nq == 0 {
+		return
+	}
+	if bd.Strict {
+		return base64.CorruptInputError(bd.offset)
+	}
+	if bd.nq == 1 {
+		bd.nq = 0
+		bd.ignore(1, errors.New("mail: base64 ends with a single character"))
+		return
+	}
+	bd.ignore(0, errors.New("mail: base64 padding missing"))
+	bd.flush()
+	return
+}
+
+// flush writes the bytes of the quantum.
+func (bd *Base64Decoder) flush() {
+	q := bd.quantum
+	switch bd.nq {
+	case 4:
+		bd.out = append(bd.out, q[0]<<2|q[1]>>4, q[1]<<4|q[2]>>2, q[2]<<6|q[3])
+	case 3:
+		bd.out = append(bd.out, q[0]<<2|q[1]>>4, q[1]<<4|q[2]>>2)
+	case 2:
+		bd.out = append(bd.out, q[0]<<2|q[1]>>4)
+	}
+	bd.nq = 0
+}
+
+func (bd *Base64Decoder) ignore(n int64, err error) {
+	bd.Ignored += n
+	if !bd.reported {
+		bd.reported = true
+		report(bd.Diagnostics, BadBase64, "", "", err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"unicode/utf8"
 )
 
 type UTF8ReaderFactory interface {
@@ -27,38 +29,347 @@ func (dc *DefaultUTF8ReaderFactory) UTF8Reader(charset string, body io.Reader) (
 
 type ISO_8859_1 struct {
 	br  io.Reader
-	buf *bytes.Buffer
+	in  []byte
+	out []byte // decoded, from pos on not read yet
+	pos int
 	err error
 }
 
 func NewISO_8859_1(r io.Reader) *ISO_8859_1 {
-	return &ISO_8859_1{br: r, buf: bytes.NewBuffer(nil)}
+	return &ISO_8859_1{br: r}
 }
 
 func (i8859 *ISO_8859_1) Read(p []byte) (n int, err error) {
-	l := len(p)
+	for {
+		if i8859.pos < len(i8859.out) {
+			n = copy(p, i8859.out[i8859.pos:])
+			i8859.pos += n
+			return
+		}
+		if i8859.err != nil {
+			return 0, i8859.err
+		}
+		i8859.fill()
+	}
+}
+
+// WriteTo writes the converted text to w as it is read.
+func (i8859 *ISO_8859_1) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if i8859.pos < len(i8859.out) {
+			m, werr := w.Write(i8859.out[i8859.pos:])
+			n += int64(m)
+			i8859.pos += m
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if i8859.err != nil {
+			if i8859.err != io.EOF {
+				err = i8859.err
+			}
+			return
+		}
+		i8859.fill()
+	}
+}
+
+func (i8859 *ISO_8859_1) fill() {
+	if i8859.in == nil {
+		i8859.in = make([]byte, 2048)
+		i8859.out = make([]byte, 0, 2*len(i8859.in))
+	}
+	var n int
+	n, i8859.err = i8859.br.Read(i8859.in)
+	out := i8859.out[:0]
+	for _, c := range i8859.in[:n] {
+		if c < utf8.RuneSelf {
+			out = append(out, c)
+		} else {
+			out = append(out, 0xc0|c>>6, 0x80|c&0x3f)
+		}
+	}
+	i8859.out, i8859.pos = out, 0
+}
+
+// InvalidBytePolicy says what PolicyUTF8ReaderFactory does with bytes that
+// are invalid in the charset they are decoded from.
+type InvalidBytePolicy int
+
+const (
+	// ReplaceInvalid replaces invalid bytes with U+FFFD, so the output is
+	// always valid UTF-8.
+	ReplaceInvalid InvalidBytePolicy = iota
+	// FailOnInvalid stops at the first invalid byte with an *InvalidByteError.
+	FailOnInvalid
+	// FallbackOnInvalid decodes invalid bytes, and bodies in unsupported
+	// charsets, with the fallback charset.
+	FallbackOnInvalid
+)
+
+// InvalidByteError reports bytes that could not be decoded to UTF-8.
+type InvalidByteError struct {
+	Charset string
+	// Offset of the bytes in the input, or -1 if the decoder does not
+	// tell, see PolicyUTF8ReaderFactory.
+	Offset int64
+	Bytes  []byte
+}
+
+func (e *InvalidByteError) Error() string {
+	return fmt.Sprintf("mail: invalid %s bytes %q at offset %d", e.Charset, e.Bytes, e.Offset)
+}
+
+// DecodeStatus is what RuneDecoder.DecodeRune found.
+type DecodeStatus int
+
+const (
+	// DecodeOK means a character was decoded.
+	DecodeOK DecodeStatus = iota
+	// DecodeInvalid means the first size bytes are invalid in the charset.
+	DecodeInvalid
+	// DecodeShort means the input ends in the middle of a character.
+	DecodeShort
+	// DecodeStateOnly means the bytes only change the state of the
+	// decoder, like the escape sequences of ISO-2022-JP.
+	DecodeStateOnly
+)
 
-	if i8859.buf.Len() >= l {
-		return i8859.buf.Read(p)
+// RuneDecoder decodes a charset one character at a time.
+type RuneDecoder interface {
+	DecodeRune(p []byte) (r rune, size int, status DecodeStatus)
+}
+
+// RuneDecoderFunc adapts a function to a RuneDecoder.
+type RuneDecoderFunc func(p []byte) (r rune, size int, status DecodeStatus)
+
+func (f RuneDecoderFunc) DecodeRune(p []byte) (rune, int, DecodeStatus) {
+	return f(p)
+}
+
+func decodeUTF8(p []byte) (rune, int, DecodeStatus) {
+	if !utf8.FullRune(p) {
+		return utf8.RuneError, 0, DecodeShort
+	}
+	r, size := utf8.DecodeRune(p)
+	if r == utf8.RuneError && size == 1 {
+		return r, 1, DecodeInvalid
 	}
+	return r, size, DecodeOK
+}
 
-	if i8859.err != nil {
-		err = i8859.err
-		n, _ = i8859.buf.Read(p)
-		return
+func decodeASCII(p []byte) (rune, int, DecodeStatus) {
+	if p[0] >= utf8.RuneSelf {
+		return utf8.RuneError, 1, DecodeInvalid
 	}
+	return rune(p[0]), 1, DecodeOK
+}
 
-	peek := make([]byte, 256)
-	var pn int
-	pn, err = i8859.br.Read(peek)
+// DecoderReader decodes what it reads to UTF-8 with a RuneDecoder. Invalid
+// bytes are handled by Policy, the default replaces them with U+FFFD.
+// Errors have the offset of the bytes in the input.
+type DecoderReader struct {
+	r        io.Reader
+	dec      RuneDecoder
+	Charset  string
+	Policy   InvalidBytePolicy
+	fallback func(b []byte) []byte // decodes invalid bytes for FallbackOnInvalid
+	in       []byte
+	nin      int   // bytes in in, from the start of an undecoded character on
+	offset   int64 // of in[0] in the input
+	out      []byte
+	pos      int
+	err      error
+}
+
+func NewDecoderReader(r io.Reader, charset string, dec RuneDecoder) *DecoderReader {
+	return &DecoderReader{r: r, dec: dec, Charset: charset}
+}
+
+func (dr *DecoderReader) Read(p []byte) (n int, err error) {
+	for {
+		if dr.pos < len(dr.out) {
+			n = copy(p, dr.out[dr.pos:])
+			dr.pos += n
+			return
+		}
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		dr.fill()
+	}
+}
+
+// decoderReadSize is how much DecoderReader reads at a time.
+const decoderReadSize = 2048
+
+func (dr *DecoderReader) fill() {
+	if dr.in == nil {
+		dr.in = make([]byte, decoderReadSize)
+		dr.out = make([]byte, 0, 2*decoderReadSize)
+	}
+	var m int
+	m, dr.err = dr.r.Read(dr.in[dr.nin:])
+	in := dr.in[:dr.nin+m]
+	atEOF := dr.err != nil
+
+	out := dr.out[:0]
+	i := 0
+	for i < len(in) {
+		r, size, status := dr.dec.DecodeRune(in[i:])
+		if status == DecodeShort {
+			// a character longer than the buffer is invalid too
+			if !atEOF && !(i == 0 && len(in) == len(dr.in)) {
+				break
+			}
+			status, size = DecodeInvalid, len(in)-i
+		}
+		if size <= 0 {
+			size = 1
+		}
+		switch status {
+		case DecodeOK:
+			var b [utf8.UTFMax]byte
+			out = append(out, b[:utf8.EncodeRune(b[:], r)]...)
+		case DecodeInvalid:
+			bad := in[i : i+size]
+			switch {
+			case dr.Policy == FailOnInvalid:
+				dr.err = &InvalidByteError{Charset: dr.Charset, Offset: dr.offset + int64(i), Bytes: append([]byte(nil), bad...)}
+				dr.out, dr.pos = out, 0
+				return
+			case dr.Policy == FallbackOnInvalid && dr.fallback != nil:
+				out = append(out, dr.fallback(bad)...)
+			default:
+				out = append(out, "\uFFFD"...)
+			}
+		}
+		i += size
+	}
+	dr.nin = copy(dr.in, in[i:])
+	dr.offset += int64(i)
+	dr.out, dr.pos = out, 0
+}
+
+// PolicyUTF8ReaderFactory wraps another UTF8ReaderFactory and applies Policy
+// to every reader it returns, and to charsets the wrapped factory does not
+// support. The policy applies to the bytes of the input when the wrapped
+// factory returns a *DecoderReader, and to UTF-8 and ASCII, which it decodes
+// itself. Of other readers only the output is known: the U+FFFD they
+// decode invalid bytes to fails FailOnInvalid with an offset of -1, and is
+// kept by the other policies.
+type PolicyUTF8ReaderFactory struct {
+	Factory         UTF8ReaderFactory // Defaults to DefaultUTF8ReaderFactory
+	Policy          InvalidBytePolicy
+	FallbackCharset string // Used by FallbackOnInvalid, defaults to iso-8859-1
+}
+
+func (pf *PolicyUTF8ReaderFactory) UTF8Reader(charset string, body io.Reader) (r io.Reader, err error) {
+	factory := pf.Factory
+	if factory == nil {
+		factory = &DefaultUTF8ReaderFactory{}
+	}
+	fallback := pf.FallbackCharset
+	if fallback == "" {
+		fallback = "iso-8859-1"
+	}
+
+	switch charset {
+	case "utf-8", "us-ascii", "ascii", "":
+		// text labelled ASCII is often UTF-8
+		r = NewDecoderReader(body, charset, RuneDecoderFunc(decodeUTF8))
+	default:
+		r, err = factory.UTF8Reader(charset, body)
+	}
 	if err != nil {
-		i8859.err = err
+		switch pf.Policy {
+		case FailOnInvalid:
+			return
+		case FallbackOnInvalid:
+			if r, err = factory.UTF8Reader(fallback, body); err != nil {
+				return
+			}
+		default:
+			// Only ASCII is safe to keep from a charset we know nothing about.
+			r, err = NewDecoderReader(body, charset, RuneDecoderFunc(decodeASCII)), nil
+		}
+	}
+
+	dr, ok := r.(*DecoderReader)
+	if !ok {
+		return &validUTF8Reader{r: r, charset: charset, policy: pf.Policy, opaque: true}, nil
+	}
+	dr.Policy = pf.Policy
+	if pf.Policy == FallbackOnInvalid {
+		dr.fallback = func(b []byte) []byte {
+			fr, err := factory.UTF8Reader(fallback, bytes.NewReader(b))
+			if err != nil {
+				return []byte("\uFFFD")
+			}
+			decoded, _ := ioutil.ReadAll(&validUTF8Reader{r: fr, charset: fallback})
+			return decoded
+		}
 	}
+	return dr, nil
+}
+
+// validUTF8Reader checks that what it reads is valid UTF-8 and handles
+// invalid bytes according to policy. When opaque, r decodes a charset that
+// is not known to the reader: the U+FFFD it returns for invalid bytes fails
+// FailOnInvalid, and offsets are not known.
+type validUTF8Reader struct {
+	r       io.Reader
+	charset string
+	policy  InvalidBytePolicy
+	opaque  bool
+	in      []byte
+	out     bytes.Buffer
+	offset  int64
+	err     error
+}
 
-	for i := 0; i < pn; i++ {
-		c := peek[i]
-		i8859.buf.WriteRune(rune(c))
+func (vr *validUTF8Reader) Read(p []byte) (n int, err error) {
+	for vr.out.Len() == 0 && vr.err == nil {
+		var scratch [512]byte
+		var rn int
+		rn, vr.err = vr.r.Read(scratch[:])
+		vr.in = append(vr.in, scratch[:rn]...)
+		vr.process(vr.err != nil)
+	}
+	if vr.out.Len() > 0 {
+		return vr.out.Read(p)
 	}
+	return 0, vr.err
+}
+
+// process moves the valid runes of vr.in to vr.out, keeping an incomplete
+// rune at the end unless atEOF.
+func (vr *validUTF8Reader) process(atEOF bool) {
+	in := vr.in
+	for len(in) > 0 {
+		if !atEOF && !utf8.FullRune(in) {
+			break
+		}
+		r, size := utf8.DecodeRune(in)
+		if r != utf8.RuneError || (size > 1 && !(vr.opaque && vr.policy == FailOnInvalid)) {
+			vr.out.Write(in[:size])
+			vr.offset += int64(size)
+			in = in[size:]
+			continue
+		}
 
-	return i8859.Read(p)
+		if vr.policy == FailOnInvalid {
+			offset := vr.offset
+			if vr.opaque {
+				offset = -1
+			}
+			vr.err = &InvalidByteError{Charset: vr.charset, Offset: offset, Bytes: append([]byte(nil), in[:size]...)}
+			vr.in = nil
+			return
+		}
+		vr.out.WriteRune(utf8.RuneError)
+		vr.offset += int64(size)
+		in = in[size:]
+	}
+	vr.in = append(vr.in[:0], in...)
 }
@@ -0,0 +1,288 @@
+package mimemail
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+)
+
+// UTF8WriterFactory is the counterpart of UTF8ReaderFactory: the returned
+// writer takes UTF-8 and writes it to w encoded in charset. Closing it ends
+// the text, for stateful charsets in their initial state.
+type UTF8WriterFactory interface {
+	UTF8Writer(charset string, w io.Writer) (wc io.WriteCloser, err error)
+}
+
+// RuneEncoder encodes runes into a charset.
+type RuneEncoder interface {
+	// EncodeRune appends the encoding of r to dst, ok is false if r can not
+	// be represented in the charset.
+	EncodeRune(dst []byte, r rune) (out []byte, ok bool)
+	// Finish appends the bytes needed to return to the initial state,
+	// for example the escape sequence back to ASCII in ISO-2022-JP.
+	Finish(dst []byte) []byte
+}
+
+// RuneEncoderFunc adapts a stateless function to a RuneEncoder.
+type RuneEncoderFunc func(dst []byte, r rune) (out []byte, ok bool)
+
+func (f RuneEncoderFunc) EncodeRune(dst []byte, r rune) ([]byte, bool) {
+	return f(dst, r)
+}
+
+func (f RuneEncoderFunc) Finish(dst []byte) []byte {
+	return dst
+}
+
+// UnencodablePolicy says what an EncoderWriter does with characters that
+// can not be represented in its charset.
+type UnencodablePolicy int
+
+const (
+	// ReplaceUnencodable writes the Replacement character instead.
+	ReplaceUnencodable UnencodablePolicy = iota
+	// FailOnUnencodable stops with an *UnencodableError.
+	FailOnUnencodable
+	// SkipUnencodable drops the character.
+	SkipUnencodable
+)
+
+// UnencodableError reports a character that can not be represented in a charset.
+type UnencodableError struct {
+	Charset string
+	Rune    rune
+	Offset  int64 // Offset of the character in the UTF-8 input
+}
+
+func (e *UnencodableError) Error() string {
+	return fmt.Sprintf("mail: %q at offset %d can not be encoded in %s", e.Rune, e.Offset, e.Charset)
+}
+
+// DefaultUTF8WriterFactory encodes only UTF-8, US-ASCII, ISO-8859-1 and
+// ISO-8859-15, under any case and their common aliases like "latin1".
+// Other charsets, like Shift_JIS or ISO-2022-JP, need a factory that makes
+// EncoderWriters from their RuneEncoders, see NewISO2022JPEncoder.
+type DefaultUTF8WriterFactory struct {
+	Policy      UnencodablePolicy
+	Replacement rune // Defaults to '?'
+}
+
+// writerCharsetAliases maps other names of the charsets of
+// DefaultUTF8WriterFactory to the names it knows.
+var writerCharsetAliases = map[string]string{
+	"utf8":        "utf-8",
+	"ascii":       "us-ascii",
+	"iso646-us":   "us-ascii",
+	"latin1":      "iso-8859-1",
+	"l1":          "iso-8859-1",
+	"iso8859-1":   "iso-8859-1",
+	"iso_8859-1":  "iso-8859-1",
+	"latin9":      "iso-8859-15",
+	"latin-9":     "iso-8859-15",
+	"iso8859-15":  "iso-8859-15",
+	"iso_8859-15": "iso-8859-15",
+}
+
+func (df *DefaultUTF8WriterFactory) UTF8Writer(charset string, w io.Writer) (wc io.WriteCloser, err error) {
+	name := strings.ToLower(strings.TrimSpace(charset))
+	if alias, ok := writerCharsetAliases[name]; ok {
+		name = alias
+	}
+	var enc RuneEncoder
+	switch name {
+	case "utf-8", "":
+		enc = RuneEncoderFunc(encodeUTF8)
+	case "us-ascii":
+		enc = RuneEncoderFunc(encodeASCII)
+	case "iso-8859-1":
+		enc = RuneEncoderFunc(encodeISO_8859_1)
+	case "iso-8859-15":
+		enc = RuneEncoderFunc(encodeISO_8859_15)
+	default:
+		err = fmt.Errorf("charset %s not supported", charset)
+		return
+	}
+	ew := NewEncoderWriter(w, charset, enc)
+	ew.Policy = df.Policy
+	if df.Replacement != 0 {
+		ew.Replacement = df.Replacement
+	}
+	wc = ew
+	return
+}
+
+// CanEncode reports whether every character of text can be represented in
+// charset by a writer from utf8WriterFactory.
+func CanEncode(charset string, text string, utf8WriterFactory UTF8WriterFactory) bool {
+	if utf8WriterFactory == nil {
+		utf8WriterFactory = &DefaultUTF8WriterFactory{}
+	}
+	wc, err := utf8WriterFactory.UTF8Writer(charset, ioutil.Discard)
+	if err != nil {
+		return false
+	}
+	if ew, ok := wc.(*EncoderWriter); ok {
+		ew.Policy = FailOnUnencodable
+	}
+	if _, err = io.WriteString(wc, text); err != nil {
+		return false
+	}
+	return wc.Close() == nil
+}
+
+func encodeUTF8(dst []byte, r rune) ([]byte, bool) {
+	var b [utf8.UTFMax]byte
+	n := utf8.EncodeRune(b[:], r)
+	return append(dst, b[:n]...), true
+}
+
+func encodeASCII(dst []byte, r rune) ([]byte, bool) {
+	if r >= utf8.RuneSelf {
+		return dst, false
+	}
+	return append(dst, byte(r)), true
+}
+
+func encodeISO_8859_1(dst []byte, r rune) ([]byte, bool) {
+	if r > 0xff {
+		return dst, false
+	}
+	return append(dst, byte(r)), true
+}
+
+var iso_8859_15Diff = map[rune]byte{
+	'€': 0xa4, 'Š': 0xa6, 'š': 0xa8, 'Ž': 0xb4, 'ž': 0xb8, 'Œ': 0xbc, 'œ': 0xbd, 'Ÿ': 0xbe,
+}
+
+func encodeISO_8859_15(dst []byte, r rune) ([]byte, bool) {
+	if c, ok := iso_8859_15Diff[r]; ok {
+		return append(dst, c), true
+	}
+	switch r {
+	case 0xa4, 0xa6, 0xa8, 0xb4, 0xb8, 0xbc, 0xbd, 0xbe:
+		return dst, false
+	}
+	return encodeISO_8859_1(dst, r)
+}
+
+// EncoderWriter encodes the UTF-8 written to it with a RuneEncoder.
+// Invalid UTF-8 is handled like U+FFFD.
+type EncoderWriter struct {
+	w           io.Writer
+	enc         RuneEncoder
+	Charset     string
+	Policy      UnencodablePolicy
+	Replacement rune
+	pending     []byte
+	buf         []byte
+	offset      int64
+}
+
+func NewEncoderWriter(w io.Writer, charset string, enc RuneEncoder) *EncoderWriter {
+	return &EncoderWriter{w: w, enc: enc, Charset: charset, Replacement: '?'}
+}
+
+func (ew *EncoderWriter) Write(p []byte) (n int, err error) {
+	pendingLen := len(ew.pending)
+	in := append(ew.pending, p...)
+	ew.buf = ew.buf[:0]
+
+	i := 0
+	for i < len(in) && utf8.FullRune(in[i:]) {
+		r, size := utf8.DecodeRune(in[i:])
+		if ew.buf, err = ew.encode(ew.buf, r); err != nil {
+			n = i - pendingLen
+			if n < 0 {
+				n = 0
+			}
+			ew.pending = ew.pending[:0]
+			if _, werr := ew.w.Write(ew.buf); werr != nil {
+				err = werr
+			}
+			return
+		}
+		i += size
+		ew.offset += int64(size)
+	}
+	ew.pending = append(ew.pending[:0], in[i:]...)
+
+	if _, err = ew.w.Write(ew.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close encodes an incomplete trailing character and returns the encoder
+// to its initial state.
+func (ew *EncoderWriter) Close() (err error) {
+	ew.buf = ew.buf[:0]
+	if len(ew.pending) > 0 {
+		ew.pending = ew.pending[:0]
+		if ew.buf, err = ew.encode(ew.buf, utf8.RuneError); err != nil {
+			return
+		}
+	}
+	ew.buf = ew.enc.Finish(ew.buf)
+	_, err = ew.w.Write(ew.buf)
+	return
+}
+
+func (ew *EncoderWriter) encode(dst []byte, r rune) ([]byte, error) {
+	out, ok := ew.enc.EncodeRune(dst, r)
+	if ok {
+		return out, nil
+	}
+	switch ew.Policy {
+	case FailOnUnencodable:
+		return dst, &UnencodableError{Charset: ew.Charset, Rune: r, Offset: ew.offset}
+	case SkipUnencodable:
+		return dst, nil
+	}
+	if out, ok = ew.enc.EncodeRune(dst, ew.Replacement); ok {
+		return out, nil
+	}
+	return append(dst, '?'), nil
+}
+
+// ISO2022JPEncoder encodes ISO-2022-JP from the JIS X 0208 part of an
+// EUC-JP encoder, which has the same code points with the high bits set.
+type ISO2022JPEncoder struct {
+	eucJP RuneEncoder
+	jis   bool
+	tmp   []byte
+}
+
+func NewISO2022JPEncoder(eucJP RuneEncoder) *ISO2022JPEncoder {
+	return &ISO2022JPEncoder{eucJP: eucJP}
+}
+
+func (je *ISO2022JPEncoder) EncodeRune(dst []byte, r rune) ([]byte, bool) {
+	if r < utf8.RuneSelf {
+		if je.jis {
+			dst = append(dst, "\x1b(B"...)
+			je.jis = false
+		}
+		return append(dst, byte(r)), true
+	}
+	var ok bool
+	je.tmp, ok = je.eucJP.EncodeRune(je.tmp[:0], r)
+	if !ok || len(je.tmp) != 2 || je.tmp[0] < 0xa1 || je.tmp[1] < 0xa1 {
+		// half-width katakana and JIS X 0212 are not part of ISO-2022-JP
+		return dst, false
+	}
+	if !je.jis {
+		dst = append(dst, "\x1b$B"...)
+		je.jis = true
+	}
+	return append(dst, je.tmp[0]&0x7f, je.tmp[1]&0x7f), true
+}
+
+func (je *ISO2022JPEncoder) Finish(dst []byte) []byte {
+	if je.jis {
+		dst = append(dst, "\x1b(B"...)
+		je.jis = false
+	}
+	return dst
+}
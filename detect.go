@@ -0,0 +1,370 @@
+package mimemail
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultDetectPrefixSize is how many bytes of a body DetectingUTF8ReaderFactory
+// looks at when it has to guess a charset.
+const DefaultDetectPrefixSize = 4096
+
+// DetectingUTF8ReaderFactory wraps another UTF8ReaderFactory and replaces the
+// charset label with a detected one when the label is missing, "unknown-8bit",
+// or contradicts the data (us-ascii with 8-bit bytes, utf-8 that is not valid
+// UTF-8, a single byte charset on data that is clearly UTF-8). A detected
+// charset that Factory does not support is not used, windows-1252 is read
+// as iso-8859-1 then, and other charsets fall back to the label.
+type DetectingUTF8ReaderFactory struct {
+	Factory    UTF8ReaderFactory // Defaults to DefaultUTF8ReaderFactory
+	PrefixSize int               // Defaults to DefaultDetectPrefixSize
+}
+
+func (df *DetectingUTF8ReaderFactory) UTF8Reader(charset string, body io.Reader) (r io.Reader, err error) {
+	factory := df.Factory
+	if factory == nil {
+		factory = &DefaultUTF8ReaderFactory{}
+	}
+	size := df.PrefixSize
+	if size <= 0 {
+		size = DefaultDetectPrefixSize
+	}
+
+	br := bufio.NewReaderSize(body, size)
+	// A short peek just means a short body, the error comes back on Read.
+	prefix, _ := br.Peek(size)
+	cut := len(prefix) == size // the body may go on after prefix
+
+	label := strings.ToLower(strings.TrimSpace(charset))
+	if labelNeedsDetection(label, prefix, cut) {
+		if detected, confidence := detectCharset(prefix, cut); detected != "" && confidence >= 0.2 {
+			if r, err = factory.UTF8Reader(detected, br); err == nil {
+				return
+			}
+			if detected == "windows-1252" {
+				if r, err = factory.UTF8Reader("iso-8859-1", br); err == nil {
+					return
+				}
+			}
+		}
+	}
+	return factory.UTF8Reader(label, br)
+}
+
+// labelNeedsDetection reports whether label can not be trusted for prefix.
+func labelNeedsDetection(label string, prefix []byte, cut bool) bool {
+	switch label {
+	case "", "unknown-8bit", "unknown", "x-unknown":
+		return true
+	case "us-ascii", "ascii":
+		return has8bit(prefix) || hasISO2022Escape(prefix)
+	case "utf-8", "utf8":
+		return !validUTF8(prefix, cut)
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		return hasUTF8Multibyte(prefix, cut)
+	}
+	return false
+}
+
+// DetectCharset guesses the charset of b, a whole text like a header value.
+// It returns a lower case charset name and a confidence between 0 and 1,
+// or "" and 0 when nothing fits.
+func DetectCharset(b []byte) (charset string, confidence float64) {
+	return detectCharset(b, false)
+}
+
+// detectCharset is DetectCharset of b, which is the start of a longer text
+// if cut.
+func detectCharset(b []byte, cut bool) (charset string, confidence float64) {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8", 1
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		return "utf-16be", 1
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}):
+		return "utf-16le", 1
+	}
+
+	if declared := declaredCharset(b); declared != "" {
+		return declared, 0.95
+	}
+
+	if !has8bit(b) {
+		if hasISO2022Escape(b) {
+			return "iso-2022-jp", 1
+		}
+		return "us-ascii", 1
+	}
+
+	if validUTF8(b, cut) {
+		return "utf-8", 0.99
+	}
+
+	for _, m := range charsetModels {
+		if s := m.score(b); s > confidence {
+			charset, confidence = m.name, s
+		}
+	}
+	if charset == "iso-8859-1" && hasC1(b) {
+		charset = "windows-1252"
+	}
+	return
+}
+
+var (
+	metaCharsetRegexp = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-z0-9_:.+-]+)`)
+	xmlEncodingRegexp = regexp.MustCompile(`(?i)^\s*<\?xml[^>]+encoding\s*=\s*["']([a-z0-9_:.+-]+)["']`)
+)
+
+// declaredCharset returns the charset named by an XML declaration or an
+// HTML meta tag in b.
+func declaredCharset(b []byte) string {
+	if m := xmlEncodingRegexp.FindSubmatch(b); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	if m := metaCharsetRegexp.FindSubmatch(b); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	return ""
+}
+
+func has8bit(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasC1 reports whether b has bytes that are control characters in
+// iso-8859-1 but punctuation in windows-1252.
+func hasC1(b []byte) bool {
+	for _, c := range b {
+		if 0x80 <= c && c <= 0x9f {
+			return true
+		}
+	}
+	return false
+}
+
+func hasISO2022Escape(b []byte) bool {
+	return bytes.Contains(b, []byte("\x1b$B")) || bytes.Contains(b, []byte("\x1b$@")) || bytes.Contains(b, []byte("\x1b(J"))
+}
+
+// validUTF8 is utf8.Valid, but if cut it accepts b being cut in the middle
+// of its last character.
+func validUTF8(b []byte, cut bool) bool {
+	for i := len(b) - 1; cut && i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				b = b[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(b)
+}
+
+func hasUTF8Multibyte(b []byte, cut bool) bool {
+	return has8bit(b) && validUTF8(b, cut)
+}
+
+type charsetModel struct {
+	name  string
+	score func(b []byte) float64
+}
+
+var charsetModels = []charsetModel{
+	{"shift_jis", shiftJISModel.score},
+	{"euc-jp", eucJPModel.score},
+	{"gbk", gbkModel.score},
+	{"big5", big5Model.score},
+	{"euc-kr", eucKRModel.score},
+	{"windows-1251", windows1251Model.score},
+	{"koi8-r", koi8RModel.score},
+	{"iso-8859-1", scoreWestern},
+}
+
+// doubleByteModel describes a double byte charset by its byte structure
+// and by the characters that are frequent in ordinary text.
+type doubleByteModel struct {
+	single   func(c byte) bool // 8-bit bytes that are characters on their own
+	lead     func(c byte) bool
+	trail    func(c byte) bool
+	frequent func(c1, c2 byte) bool
+}
+
+func (m *doubleByteModel) score(b []byte) float64 {
+	var chars, hits, bad int
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c < 0x80 {
+			continue
+		}
+		if m.single != nil && m.single(c) {
+			chars++
+			continue
+		}
+		if !m.lead(c) {
+			bad++
+			continue
+		}
+		if i+1 == len(b) {
+			// cut by the prefix
+			break
+		}
+		if !m.trail(b[i+1]) {
+			bad++
+			continue
+		}
+		chars++
+		if m.frequent(c, b[i+1]) {
+			hits++
+		}
+		i++
+	}
+	if chars == 0 || bad*20 > chars {
+		return 0
+	}
+	return float64(hits) / float64(chars+bad)
+}
+
+func inRange(lo, hi byte) func(c byte) bool {
+	return func(c byte) bool {
+		return lo <= c && c <= hi
+	}
+}
+
+// pairSet builds a frequent function from concatenated two byte characters.
+func pairSet(chars string) func(c1, c2 byte) bool {
+	set := make(map[uint16]bool, len(chars)/2)
+	for i := 0; i+1 < len(chars); i += 2 {
+		set[uint16(chars[i])<<8|uint16(chars[i+1])] = true
+	}
+	return func(c1, c2 byte) bool {
+		return set[uint16(c1)<<8|uint16(c2)]
+	}
+}
+
+// Japanese text is recognised by its kana and punctuation, Chinese and Korean
+// text by their most frequent characters.
+var (
+	shiftJISModel = &doubleByteModel{
+		single: inRange(0xa1, 0xdf), // half-width katakana
+		lead: func(c byte) bool {
+			return (0x81 <= c && c <= 0x9f) || (0xe0 <= c && c <= 0xfc)
+		},
+		trail: func(c byte) bool {
+			return 0x40 <= c && c <= 0xfc && c != 0x7f
+		},
+		frequent: func(c1, c2 byte) bool {
+			return (c1 == 0x82 && 0x9f <= c2 && c2 <= 0xf1) ||
+				(c1 == 0x83 && 0x40 <= c2 && c2 <= 0x96) ||
+				(c1 == 0x81 && 0x40 <= c2 && c2 <= 0x5b)
+		},
+	}
+
+	eucJPModel = &doubleByteModel{
+		lead:  func(c byte) bool { return c == 0x8e || (0xa1 <= c && c <= 0xfe) },
+		trail: inRange(0xa1, 0xfe),
+		frequent: func(c1, c2 byte) bool {
+			return c1 == 0xa4 || c1 == 0xa5 || c1 == 0xa1
+		},
+	}
+
+	gbkModel = &doubleByteModel{
+		lead: inRange(0x81, 0xfe),
+		trail: func(c byte) bool {
+			return 0x40 <= c && c <= 0xfe && c != 0x7f
+		},
+		// 的一是不了在人有我他这个们中来上大为和国地到以说时要就出会可也你对生能而子那得于着下自之年过发后作里用道行所然家种事成方多经么去法学如都同现当没动面起看定天分还进好小部其些主样理心她本前开但因只从想实，。
+		frequent: pairSet("\xb5\xc4\xd2\xbb\xca\xc7\xb2\xbb\xc1\xcb\xd4\xda\xc8\xcb\xd3\xd0\xce\xd2\xcb\xfb\xd5\xe2\xb8\xf6\xc3\xc7\xd6\xd0\xc0\xb4\xc9\xcf\xb4\xf3\xce\xaa\xba\xcd\xb9\xfa\xb5\xd8\xb5\xbd\xd2\xd4\xcb\xb5\xca\xb1\xd2\xaa\xbe\xcd\xb3\xf6\xbb\xe1\xbf\xc9\xd2\xb2\xc4\xe3\xb6\xd4\xc9\xfa\xc4\xdc\xb6\xf8\xd7\xd3\xc4\xc7\xb5\xc3\xd3\xda\xd7\xc5\xcf\xc2\xd7\xd4\xd6\xae\xc4\xea\xb9\xfd\xb7\xa2\xba\xf3\xd7\xf7\xc0\xef\xd3\xc3\xb5\xc0\xd0\xd0\xcb\xf9\xc8\xbb\xbc\xd2\xd6\xd6\xca\xc2\xb3\xc9\xb7\xbd\xb6\xe0\xbe\xad\xc3\xb4\xc8\xa5\xb7\xa8\xd1\xa7\xc8\xe7\xb6\xbc\xcd\xac\xcf\xd6\xb5\xb1\xc3\xbb\xb6\xaf\xc3\xe6\xc6\xf0\xbf\xb4\xb6\xa8\xcc\xec\xb7\xd6\xbb\xb9\xbd\xf8\xba\xc3\xd0\xa1\xb2\xbf\xc6\xe4\xd0\xa9\xd6\xf7\xd1\xf9\xc0\xed\xd0\xc4\xcb\xfd\xb1\xbe\xc7\xb0\xbf\xaa\xb5\xab\xd2\xf2\xd6\xbb\xb4\xd3\xcf\xeb\xca\xb5\xa3\xac\xa1\xa3"),
+	}
+
+	big5Model = &doubleByteModel{
+		lead: inRange(0x81, 0xfe),
+		trail: func(c byte) bool {
+			return (0x40 <= c && c <= 0x7e) || (0xa1 <= c && c <= 0xfe)
+		},
+		// 的一是不了在人有我他這個們中來上大為和國地到以說時要就出會可也你對生能而子那得於著下自之年過發後作裡用道行所然家種事成方多經麼去法學如都同現當沒動面起看定天分還進好小部其些主樣理心她本前開但因只從想實，。
+		frequent: pairSet("\xaa\xba\xa4\x40\xac\x4f\xa4\xa3\xa4\x46\xa6\x62\xa4\x48\xa6\xb3\xa7\xda\xa5\x4c\xb3\x6f\xad\xd3\xad\xcc\xa4\xa4\xa8\xd3\xa4\x57\xa4\x6a\xac\xb0\xa9\x4d\xb0\xea\xa6\x61\xa8\xec\xa5\x48\xbb\xa1\xae\xc9\xad\x6e\xb4\x4e\xa5\x58\xb7\x7c\xa5\x69\xa4\x5d\xa7\x41\xb9\xef\xa5\xcd\xaf\xe0\xa6\xd3\xa4\x6c\xa8\xba\xb1\x6f\xa9\xf3\xb5\xdb\xa4\x55\xa6\xdb\xa4\xa7\xa6\x7e\xb9\x4c\xb5\x6f\xab\xe1\xa7\x40\xb8\xcc\xa5\xce\xb9\x44\xa6\xe6\xa9\xd2\xb5\x4d\xae\x61\xba\xd8\xa8\xc6\xa6\xa8\xa4\xe8\xa6\x68\xb8\x67\xbb\xf2\xa5\x68\xaa\x6b\xbe\xc7\xa6\x70\xb3\xa3\xa6\x50\xb2\x7b\xb7\xed\xa8\x53\xb0\xca\xad\xb1\xb0\x5f\xac\xdd\xa9\x77\xa4\xd1\xa4\xc0\xc1\xd9\xb6\x69\xa6\x6e\xa4\x70\xb3\xa1\xa8\xe4\xa8\xc7\xa5\x44\xbc\xcb\xb2\x7a\xa4\xdf\xa6\x6f\xa5\xbb\xab\x65\xb6\x7d\xa6\xfd\xa6\x5d\xa5\x75\xb1\x71\xb7\x51\xb9\xea\xa1\x41\xa1\x43"),
+	}
+
+	eucKRModel = &doubleByteModel{
+		lead:  inRange(0xa1, 0xfe),
+		trail: inRange(0xa1, 0xfe),
+		// 이다는의에가하고을를지기로서한사리자수대도어아니시일그정인해게나보요라면내들것있적과제으전부우만거주원상성장년말
+		frequent: pairSet("\xc0\xcc\xb4\xd9\xb4\xc2\xc0\xc7\xbf\xa1\xb0\xa1\xc7\xcf\xb0\xed\xc0\xbb\xb8\xa6\xc1\xf6\xb1\xe2\xb7\xce\xbc\xad\xc7\xd1\xbb\xe7\xb8\xae\xc0\xda\xbc\xf6\xb4\xeb\xb5\xb5\xbe\xee\xbe\xc6\xb4\xcf\xbd\xc3\xc0\xcf\xb1\xd7\xc1\xa4\xc0\xce\xc7\xd8\xb0\xd4\xb3\xaa\xba\xb8\xbf\xe4\xb6\xf3\xb8\xe9\xb3\xbb\xb5\xe9\xb0\xcd\xc0\xd6\xc0\xfb\xb0\xfa\xc1\xa6\xc0\xb8\xc0\xfc\xba\xce\xbf\xec\xb8\xb8\xb0\xc5\xc1\xd6\xbf\xf8\xbb\xf3\xbc\xba\xc0\xe5\xb3\xe2\xb8\xbb"),
+	}
+)
+
+// singleByteModel recognises a single byte charset by the bytes of its most
+// frequent letters.
+type singleByteModel struct {
+	frequent [256]bool
+}
+
+func newSingleByteModel(letters string) *singleByteModel {
+	m := &singleByteModel{}
+	for i := 0; i < len(letters); i++ {
+		m.frequent[letters[i]] = true
+	}
+	return m
+}
+
+func (m *singleByteModel) score(b []byte) float64 {
+	var high, hits int
+	for _, c := range b {
+		if c < 0x80 {
+			continue
+		}
+		high++
+		if m.frequent[c] {
+			hits++
+		}
+	}
+	if high == 0 {
+		return 0
+	}
+	return float64(hits) / float64(high)
+}
+
+// The sixteen most frequent lower case letters of Russian, оеаинтсрвлкмдпуя.
+var (
+	windows1251Model = newSingleByteModel("\xee\xe5\xe0\xe8\xed\xf2\xf1\xf0\xe2\xeb\xea\xec\xe4\xef\xf3\xff")
+	koi8RModel       = newSingleByteModel("\xcf\xc5\xc1\xc9\xce\xd4\xd3\xd2\xd7\xcc\xcb\xcd\xc4\xd0\xd5\xd1")
+)
+
+// scoreWestern recognises Western European text: accented letters sit inside
+// words made of ASCII letters, and the C1 range only holds windows-1252
+// punctuation.
+func scoreWestern(b []byte) float64 {
+	var high, hits int
+	for i, c := range b {
+		if c < 0x80 {
+			continue
+		}
+		high++
+		switch {
+		case c >= 0xc0 && c != 0xd7 && c != 0xf7:
+			if (i > 0 && isASCIILetter(b[i-1])) || (i+1 < len(b) && isASCIILetter(b[i+1])) {
+				hits++
+			}
+		case c == 0x80 || (0x91 <= c && c <= 0x97) || c == 0xa0 || c == 0xab || c == 0xbb:
+			hits++
+		}
+	}
+	if high == 0 {
+		return 0
+	}
+	return float64(hits) / float64(high) * 0.9
+}
+
+func isASCIILetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
@@ -0,0 +1,85 @@
+package mimemail
+
+import (
+	"fmt"
+	"log"
+)
+
+// DiagnosticKind is a kind of non-standard construct met while decoding.
+type DiagnosticKind int
+
+const (
+	// EncodedWordInQuotedString is an encoded-word in a quoted display
+	// name, which RFC 2047 section 5 forbids but many mailers write.
+	EncodedWordInQuotedString DiagnosticKind = iota
+	// BadBase64 is base64 with bad padding or characters outside the alphabet.
+	BadBase64
+	// InvalidQEscape is an "=" that is not followed by two hex digits.
+	InvalidQEscape
+	// UnsupportedCharset is a charset the UTF8ReaderFactory can not decode.
+	UnsupportedCharset
+	// EightBitHeader is raw 8-bit text in a header, outside of encoded-words.
+	EightBitHeader
+	// UnknownTransferEncoding is a Content-Transfer-Encoding that is not
+	// registered, or a misspelling of one that is.
+	UnknownTransferEncoding
+)
+
+var diagnosticKindNames = []string{
+	EncodedWordInQuotedString: "encoded-word in quoted string",
+	BadBase64:                 "bad base64",
+	InvalidQEscape:            "invalid quoted-printable escape",
+	UnsupportedCharset:        "unsupported charset",
+	EightBitHeader:            "8-bit header",
+	UnknownTransferEncoding:   "unknown transfer encoding",
+}
+
+func (k DiagnosticKind) String() string {
+	if int(k) < len(diagnosticKindNames) {
+		return diagnosticKindNames[k]
+	}
+	return fmt.Sprintf("DiagnosticKind(%d)", int(k))
+}
+
+// Diagnostic describes one non-standard construct.
+type Diagnostic struct {
+	Kind    DiagnosticKind
+	Text    string // The text concerned, like the encoded-word or the escape
+	Charset string
+	Err     error // The error the construct caused, if any
+}
+
+func (d *Diagnostic) String() string {
+	s := fmt.Sprintf("%v: %q", d.Kind, d.Text)
+	if d.Charset != "" {
+		s += " in " + d.Charset
+	}
+	if d.Err != nil {
+		s += ": " + d.Err.Error()
+	}
+	return s
+}
+
+// Diagnostics receives what the decoders report. Reporting does not
+// change what they decode.
+type Diagnostics interface {
+	Report(d *Diagnostic)
+}
+
+// DiagnosticsFunc adapts a function to Diagnostics.
+type DiagnosticsFunc func(d *Diagnostic)
+
+func (f DiagnosticsFunc) Report(d *Diagnostic) {
+	f(d)
+}
+
+// LogDiagnostics prints every report with log.Printf.
+var LogDiagnostics = DiagnosticsFunc(func(d *Diagnostic) {
+	log.Printf("mail: %v", d)
+})
+
+func report(diag Diagnostics, kind DiagnosticKind, text string, charset string, err error) {
+	if diag != nil {
+		diag.Report(&Diagnostic{Kind: kind, Text: text, Charset: charset, Err: err})
+	}
+}
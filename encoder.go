@@ -0,0 +1,277 @@
+package mimemail
+
+import (
+	"io"
+)
+
+// maxQLineLen is the longest line quoted-printable allows, RFC 2045 section 6.7 (5).
+const maxQLineLen = 76
+
+const upperhex = "0123456789ABCDEF"
+
+// QEncoder encodes quoted-printable, RFC 2045 section 6.7, or the "Q"
+// encoding of encoded-words when IsHeader is set. Whitespace and a CR are
+// held back until it is known whether a line ends after them.
+type QEncoder struct {
+	w   io.Writer
+	buf []byte
+	err error
+	col int
+
+	pendingSpace byte // whitespace that must be encoded if the line ends after it
+	pendingCR    bool
+
+	IsHeader bool
+	// Binary encodes CR and LF too, for data that is not text. Otherwise
+	// line breaks are kept and written as CRLF.
+	Binary bool
+	// LineLength is the longest line written, including the "=" of a soft
+	// line break, defaults to 76.
+	LineLength int
+	// ProtectDots encodes a "." at the start of a line, for SMTP.
+	ProtectDots bool
+	// ProtectFrom encodes an "F" at the start of a line, so that mbox
+	// files do not take a "From " line for the start of a message.
+	ProtectFrom bool
+}
+
+func NewQEncoder(w io.Writer, isHeader bool) *QEncoder {
+	return &QEncoder{w: w, IsHeader: isHeader}
+}
+
+func (qe *QEncoder) Write(p []byte) (n int, err error) {
+	if qe.err != nil {
+		return 0, qe.err
+	}
+	qe.buf = qe.buf[:0]
+	if qe.IsHeader {
+		for _, c := range p {
+			qe.buf = appendQByte(qe.buf, c)
+		}
+	} else {
+		for _, c := range p {
+			qe.encode(c)
+		}
+	}
+	if _, err = qe.w.Write(qe.buf); err != nil {
+		qe.err = err
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes what is held back, encoding whitespace at the end of the text.
+func (qe *QEncoder) Close() (err error) {
+	if qe.err != nil {
+		return qe.err
+	}
+	qe.buf = qe.buf[:0]
+	qe.flushPending()
+	if _, err = qe.w.Write(qe.buf); err != nil {
+		qe.err = err
+	}
+	return
+}
+
+func (qe *QEncoder) encode(c byte) {
+	if qe.pendingCR {
+		qe.pendingCR = false
+		if c == '\n' {
+			qe.hardBreak()
+			return
+		}
+		qe.flushSpace(false)
+		qe.appendEncoded('\r', true)
+	}
+
+	if !qe.Binary {
+		switch c {
+		case '\r':
+			qe.pendingCR = true
+			return
+		case '\n':
+			qe.hardBreak()
+			return
+		}
+	}
+
+	qe.flushSpace(false)
+	if c == ' ' || c == '\t' {
+		qe.pendingSpace = c
+		return
+	}
+	qe.appendEncoded(c, c == '=' || c < ' ' || c > '~')
+}
+
+// hardBreak ends the line, RFC 2045 section 6.7 (3) requires whitespace
+// at its end to be encoded.
+func (qe *QEncoder) hardBreak() {
+	qe.flushSpace(true)
+	qe.buf = append(qe.buf, "\r\n"...)
+	qe.col = 0
+}
+
+func (qe *QEncoder) flushPending() {
+	if qe.pendingCR {
+		qe.pendingCR = false
+		qe.flushSpace(false)
+		qe.appendEncoded('\r', true)
+	}
+	qe.flushSpace(true)
+}
+
+func (qe *QEncoder) flushSpace(atEnd bool) {
+	if qe.pendingSpace == 0 {
+		return
+	}
+	qe.appendEncoded(qe.pendingSpace, atEnd)
+	qe.pendingSpace = 0
+}
+
+// appendEncoded writes c, with a soft line break before it if the line
+// would be too long.
+func (qe *QEncoder) appendEncoded(c byte, encode bool) {
+	lineLen := qe.LineLength
+	if lineLen <= 0 {
+		lineLen = maxQLineLen
+	}
+	for {
+		enc := encode ||
+			(qe.col == 0 && qe.ProtectDots && c == '.') ||
+			(qe.col == 0 && qe.ProtectFrom && c == 'F')
+		l := 1
+		if enc {
+			l = 3
+		}
+		// leave room for the "=" of a soft line break
+		if qe.col > 0 && qe.col+l > lineLen-1 {
+			qe.buf = append(qe.buf, "=\r\n"...)
+			qe.col = 0
+			continue
+		}
+		if enc {
+			qe.buf = append(qe.buf, '=', upperhex[c>>4], upperhex[c&0x0f])
+		} else {
+			qe.buf = append(qe.buf, c)
+		}
+		qe.col += l
+		return
+	}
+}
+
+// appendQByte appends c in the "Q" encoding of encoded-words.
+func appendQByte(dst []byte, c byte) []byte {
+	switch {
+	case c == ' ':
+		return append(dst, '_')
+	case isQWordSafe(c):
+		return append(dst, c)
+	}
+	return append(dst, '=', upperhex[c>>4], upperhex[c&0x0f])
+}
+
+// maxBase64LineLen is the longest line base64 allows, RFC 2045 section 6.8.
+const maxBase64LineLen = 76
+
+// Base64Encoder encodes base64, RFC 2045 section 6.8. Lines are wrapped
+// unless IsHeader is set, for the "B" encoding of encoded-words. It holds
+// back at most two bytes, so it can encode any size of data.
+type Base64Encoder struct {
+	w       io.Writer
+	buf     []byte
+	err     error
+	col     int
+	pending [3]byte
+	np      int
+
+	IsHeader   bool
+	LineLength int    // Defaults to 76
+	LineEnding string // Defaults to "\r\n"
+}
+
+func NewBase64Encoder(w io.Writer, isHeader bool) *Base64Encoder {
+	return &Base64Encoder{w: w, IsHeader: isHeader}
+}
+
+// base64Chunk is how much Base64Encoder encodes before it writes.
+const base64Chunk = 3072
+
+func (be *Base64Encoder) Write(p []byte) (n int, err error) {
+	if be.err != nil {
+		return 0, be.err
+	}
+	for len(p) > 0 {
+		be.buf = be.buf[:0]
+		chunk := p
+		if len(chunk) > base64Chunk {
+			chunk = chunk[:base64Chunk]
+		}
+		for _, c := range chunk {
+			be.pending[be.np] = c
+			be.np++
+			if be.np == 3 {
+				be.encode()
+			}
+		}
+		if _, err = be.w.Write(be.buf); err != nil {
+			be.err = err
+			return
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return
+}
+
+// Close writes the last bytes with padding.
+func (be *Base64Encoder) Close() (err error) {
+	if be.err != nil {
+		return be.err
+	}
+	be.buf = be.buf[:0]
+	if be.np > 0 {
+		be.encode()
+	}
+	if _, err = be.w.Write(be.buf); err != nil {
+		be.err = err
+	}
+	return
+}
+
+// encode encodes the pending bytes, padding them if there are less than 3.
+func (be *Base64Encoder) encode() {
+	p := be.pending
+	for i := be.np; i < 3; i++ {
+		p[i] = 0
+	}
+	quantum := [4]byte{
+		base64Alphabet[p[0]>>2],
+		base64Alphabet[(p[0]&0x03)<<4|p[1]>>4],
+		base64Alphabet[(p[1]&0x0f)<<2|p[2]>>6],
+		base64Alphabet[p[2]&0x3f],
+	}
+	switch be.np {
+	case 1:
+		quantum[2], quantum[3] = '=', '='
+	case 2:
+		quantum[3] = '='
+	}
+	be.np = 0
+
+	lineLen := be.LineLength
+	if lineLen <= 0 {
+		lineLen = maxBase64LineLen
+	}
+	for _, c := range quantum {
+		if !be.IsHeader && be.col >= lineLen {
+			if be.LineEnding == "" {
+				be.buf = append(be.buf, "\r\n"...)
+			} else {
+				be.buf = append(be.buf, be.LineEnding...)
+			}
+			be.col = 0
+		}
+		be.buf = append(be.buf, c)
+		be.col++
+	}
+}
@@ -0,0 +1,56 @@
+package mimemail
+
+import (
+	"io"
+)
+
+// ByteSet is a set of byte values.
+type ByteSet [256]bool
+
+func NewByteSet(chars string) *ByteSet {
+	s := &ByteSet{}
+	for i := 0; i < len(chars); i++ {
+		s[chars[i]] = true
+	}
+	return s
+}
+
+var (
+	// LineBreakBytes are the bytes of line breaks.
+	LineBreakBytes = NewByteSet("\r\n")
+	// WhitespaceBytes are what base64 decoders skip, RFC 2045 section 6.8.
+	WhitespaceBytes = NewByteSet(" \t\r\n\v\f")
+	// CRBytes is just CR, dropping it turns CRLF line breaks into LF.
+	CRBytes = NewByteSet("\r")
+)
+
+// ByteFilterReader drops the bytes in a ByteSet from what it reads.
+type ByteFilterReader struct {
+	r    io.Reader
+	drop *ByteSet
+	err  error
+}
+
+func NewByteFilterReader(r io.Reader, drop *ByteSet) *ByteFilterReader {
+	return &ByteFilterReader{r: r, drop: drop}
+}
+
+// Read filters in p itself, so it needs no buffer. It only returns 0 bytes
+// at the end of the input or on error.
+func (fr *ByteFilterReader) Read(p []byte) (n int, err error) {
+	for len(p) > 0 && fr.err == nil {
+		var m int
+		m, fr.err = fr.r.Read(p)
+		for _, b := range p[:m] {
+			if fr.drop[b] {
+				continue
+			}
+			p[n] = b
+			n++
+		}
+		if n > 0 {
+			return
+		}
+	}
+	return 0, fr.err
+}
@@ -0,0 +1,216 @@
+package mimemail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FieldDecoder decodes the value of a header field.
+type FieldDecoder func(value string, opts *DecodeOptions) (decoded string, err error)
+
+// fieldDecodersMu guards fieldDecoders, which RegisterFieldDecoder changes.
+var fieldDecodersMu sync.RWMutex
+
+// fieldDecoders maps canonical field names to their decoders. Fields that
+// are not in it are copied as they are by DecodeHeader.
+var fieldDecoders = map[string]FieldDecoder{
+	"Subject":             DecodeUnstructured,
+	"Comments":            DecodeUnstructured,
+	"Keywords":            DecodeUnstructured,
+	"Content-Description": DecodeUnstructured,
+	"Thread-Topic":        DecodeUnstructured,
+
+	"From":                        DecodeAddressField,
+	"Sender":                      DecodeAddressField,
+	"Reply-To":                    DecodeAddressField,
+	"To":                          DecodeAddressField,
+	"Cc":                          DecodeAddressField,
+	"Bcc":                         DecodeAddressField,
+	"Resent-From":                 DecodeAddressField,
+	"Resent-Sender":               DecodeAddressField,
+	"Resent-To":                   DecodeAddressField,
+	"Resent-Cc":                   DecodeAddressField,
+	"Resent-Bcc":                  DecodeAddressField,
+	"Disposition-Notification-To": DecodeAddressField,
+
+	"Content-Type":        DecodeParameterField,
+	"Content-Disposition": DecodeParameterField,
+}
+
+// RegisterFieldDecoder makes DecodeHeader decode the named field, for
+// example an X- header, with fd. It replaces any decoder the field had, a
+// nil fd removes it. It is safe to call while headers are decoded.
+func RegisterFieldDecoder(key string, fd FieldDecoder) {
+	fieldDecodersMu.Lock()
+	defer fieldDecodersMu.Unlock()
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	if fd == nil {
+		delete(fieldDecoders, key)
+		return
+	}
+	fieldDecoders[key] = fd
+}
+
+func fieldDecoder(key string) FieldDecoder {
+	fieldDecodersMu.RLock()
+	defer fieldDecodersMu.RUnlock()
+	return fieldDecoders[textproto.CanonicalMIMEHeaderKey(key)]
+}
+
+// DecodeHeader returns a copy of header with the values of every registered
+// field decoded to UTF-8. A value that fails to decode is copied as it is,
+// and the first such error is returned along with the copy.
+func DecodeHeader(header textproto.MIMEHeader, opts *DecodeOptions) (decoded textproto.MIMEHeader, err error) {
+	decoded = make(textproto.MIMEHeader, len(header))
+	for key, values := range header {
+		fd := fieldDecoder(key)
+		newValues := make([]string, len(values))
+		for i, value := range values {
+			newValues[i] = value
+			if fd == nil {
+				continue
+			}
+			newValue, ferr := fd(value, opts)
+			if ferr != nil {
+				if err == nil {
+					err = fmt.Errorf("mail: can not decode %s: %v", key, ferr)
+				}
+				continue
+			}
+			newValues[i] = newValue
+		}
+		decoded[key] = newValues
+	}
+	return
+}
+
+// DecodeUnstructured decodes an unstructured field like Subject, where
+// encoded-words can be anywhere.
+func DecodeUnstructured(value string, opts *DecodeOptions) (decoded string, err error) {
+	return DecodeTextWithOptions(value, opts)
+}
+
+// DecodeAddressField decodes an address list field like From or To through
+// the address parser, so only display names are decoded, and formats the
+// addresses again with their names in UTF-8.
+func DecodeAddressField(value string, opts *DecodeOptions) (decoded string, err error) {
+	var list []*Address
+	if list, err = newAddrParser(string(opts.decode8bit([]byte(value))), opts).parseAddressList(); err != nil {
+		return
+	}
+	b := bytes.NewBuffer(nil)
+	for i, a := range list {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if a.Name != "" {
+			writePhrase(b, a.Name)
+			b.WriteByte(' ')
+		}
+		b.WriteString("<" + a.Address + ">")
+	}
+	decoded = b.String()
+	return
+}
+
+// DecodeParameterField decodes a MIME field with parameters like
+// Content-Type, including RFC 2231 parameter values and encoded-words
+// that some mailers put into quoted parameter values.
+func DecodeParameterField(value string, opts *DecodeOptions) (decoded string, err error) {
+	var mediatype string
+	var params map[string]string
+	if mediatype, params, err = mime.ParseMediaType(string(opts.decode8bit([]byte(value)))); err != nil {
+		return
+	}
+
+	if err = decodeParamValues(params, opts); err != nil {
+		return
+	}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b := bytes.NewBufferString(mediatype)
+	for _, key := range keys {
+		b.WriteString("; " + key + "=")
+		writeQuotedIfNeeded(b, params[key], isParamTokenChar)
+	}
+	decoded = b.String()
+	return
+}
+
+// decodeParamValues decodes the encoded-words that some mailers put into
+// quoted parameter values. A value that fails to decode is left as it is,
+// and the first error is returned.
+func decodeParamValues(params map[string]string, opts *DecodeOptions) (err error) {
+	// encoded-words in parameter values are usually glued to the
+	// file extension, so they are not delimited by whitespace
+	lenient := DecodeOptions{}
+	if opts != nil {
+		lenient = *opts
+	}
+	lenient.Lenient = true
+
+	for key, v := range params {
+		if !strings.Contains(v, "=?") {
+			continue
+		}
+		decoded, derr := DecodeTextWithOptions(v, &lenient)
+		if derr != nil {
+			if err == nil {
+				err = derr
+			}
+			continue
+		}
+		params[key] = decoded
+	}
+	return
+}
+
+// writePhrase writes a display name, quoted when it has characters
+// that are not allowed in an atom. The name is decoded, so its UTF-8
+// characters are allowed as RFC 6532 does.
+func writePhrase(b *bytes.Buffer, s string) {
+	writeQuotedIfNeeded(b, s, func(c byte) bool {
+		return c == ' ' || c >= 0x80 || isAtext(c, false)
+	})
+}
+
+func writeQuotedIfNeeded(b *bytes.Buffer, s string, plain func(c byte) bool) {
+	quote := s == ""
+	for i := 0; i < len(s); i++ {
+		if !plain(s[i]) {
+			quote = true
+			break
+		}
+	}
+	if !quote {
+		b.WriteString(s)
+		return
+	}
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+}
+
+// isParamTokenChar reports whether c can appear in an unquoted MIME
+// parameter value, RFC 2045 section 5.1.
+func isParamTokenChar(c byte) bool {
+	if c <= ' ' || c > '~' {
+		return false
+	}
+	return strings.IndexByte(`()<>@,;:\"/[]?=`, c) == -1
+}
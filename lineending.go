@@ -0,0 +1,145 @@
+package mimemail
+
+import (
+	"io"
+	"mime"
+	"strings"
+)
+
+// lineConverter rewrites LF, CRLF and bare CR line breaks as eol.
+type lineConverter struct {
+	eol       string
+	pendingCR bool // a CR that may be followed by LF
+}
+
+func (lc *lineConverter) convert(dst []byte, src []byte) []byte {
+	for _, c := range src {
+		if lc.pendingCR {
+			lc.pendingCR = false
+			dst = append(dst, lc.eol...)
+			if c == '\n' {
+				continue
+			}
+		}
+		switch c {
+		case '\r':
+			lc.pendingCR = true
+		case '\n':
+			dst = append(dst, lc.eol...)
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+func (lc *lineConverter) flush(dst []byte) []byte {
+	if lc.pendingCR {
+		lc.pendingCR = false
+		dst = append(dst, lc.eol...)
+	}
+	return dst
+}
+
+// LineEndingReader converts the line breaks of what it reads, LF, CRLF
+// and bare CR alike, to CRLF or LF.
+type LineEndingReader struct {
+	r   io.Reader
+	lc  lineConverter
+	in  []byte
+	out []byte // converted, from pos on not read yet
+	pos int
+	err error
+}
+
+// NewCRLFReader returns a reader with CRLF line breaks, the canonical form
+// of RFC 5322 that signatures are computed on.
+func NewCRLFReader(r io.Reader) *LineEndingReader {
+	return &LineEndingReader{r: r, lc: lineConverter{eol: "\r\n"}}
+}
+
+// NewLFReader returns a reader with LF line breaks.
+func NewLFReader(r io.Reader) *LineEndingReader {
+	return &LineEndingReader{r: r, lc: lineConverter{eol: "\n"}}
+}
+
+func (lr *LineEndingReader) Read(p []byte) (n int, err error) {
+	for {
+		if lr.pos < len(lr.out) {
+			n = copy(p, lr.out[lr.pos:])
+			lr.pos += n
+			return
+		}
+		if lr.err != nil {
+			return 0, lr.err
+		}
+		if lr.in == nil {
+			lr.in = make([]byte, 4096)
+			lr.out = make([]byte, 0, 2*len(lr.in))
+		}
+		var m int
+		m, lr.err = lr.r.Read(lr.in)
+		lr.out, lr.pos = lr.lc.convert(lr.out[:0], lr.in[:m]), 0
+		if lr.err != nil {
+			lr.out = lr.lc.flush(lr.out)
+		}
+	}
+}
+
+// LineEndingWriter converts the line breaks of what is written to it to
+// CRLF or LF. A CR at the end of a write is held back in case the next
+// write starts with LF.
+type LineEndingWriter struct {
+	w   io.Writer
+	lc  lineConverter
+	buf []byte
+}
+
+func NewCRLFWriter(w io.Writer) *LineEndingWriter {
+	return &LineEndingWriter{w: w, lc: lineConverter{eol: "\r\n"}}
+}
+
+func NewLFWriter(w io.Writer) *LineEndingWriter {
+	return &LineEndingWriter{w: w, lc: lineConverter{eol: "\n"}}
+}
+
+func (lw *LineEndingWriter) Write(p []byte) (n int, err error) {
+	lw.buf = lw.lc.convert(lw.buf[:0], p)
+	if _, err = lw.w.Write(lw.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes the line break of a CR that is held back.
+func (lw *LineEndingWriter) Close() (err error) {
+	lw.buf = lw.lc.flush(lw.buf[:0])
+	_, err = lw.w.Write(lw.buf)
+	return
+}
+
+// CanNormalizeLineEndings reports whether the line breaks of a part with
+// the given Content-Type and Content-Transfer-Encoding can be converted
+// without changing its content. Line breaks in base64, quoted-printable
+// and uuencoded data are not content, in 7bit and 8bit data they are only
+// line breaks for text, and binary data is never touched. A multipart or
+// an enclosed message may have binary parts, so it is false for those
+// and each part has to be checked on its own, see Walk.
+func CanNormalizeLineEndings(contentType string, transferEncoding string) bool {
+	switch NormalizeTransferEncoding(transferEncoding) {
+	case "base64", "quoted-printable", "x-uuencode":
+		return true
+	case "7bit", "8bit":
+	default:
+		return false
+	}
+
+	mediatype := "text/plain" // RFC 2045 section 5.2
+	if contentType != "" {
+		var err error
+		if mediatype, _, err = mime.ParseMediaType(contentType); err != nil {
+			return false
+		}
+	}
+	return strings.HasPrefix(mediatype, "text/")
+}
@@ -0,0 +1,250 @@
+package mimemail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Header is the header of a message or a part. Its values are as they are
+// in the message, the methods decode them with the options of Parse.
+type Header struct {
+	textproto.MIMEHeader
+	opts *DecodeOptions
+}
+
+// Decoded returns the first value of the field decoded by its registered
+// FieldDecoder, see DecodeHeader. Fields without one are returned as they are.
+func (h Header) Decoded(key string) (decoded string, err error) {
+	decoded = h.Get(key)
+	fd := fieldDecoder(key)
+	if fd == nil || decoded == "" {
+		return
+	}
+	return fd(decoded, h.opts)
+}
+
+func (h Header) AddressList(key string) (r []*Address, err error) {
+	return AddressListWithOptions(h.MIMEHeader, key, h.opts)
+}
+
+func (h Header) Date() (time.Time, error) {
+	return Date(h.MIMEHeader)
+}
+
+// Message is a parsed message, the root of its tree of parts. The Header
+// of the root part is the message header.
+type Message struct {
+	*Part
+}
+
+// PartHeader is the header of a part, or of the whole message, with the
+// MIME fields parsed from it.
+type PartHeader struct {
+	Header Header
+
+	ContentType      string            // Lower case, like "text/plain", the default
+	Params           map[string]string // Of Content-Type, like "charset" and "boundary"
+	TransferEncoding string            // Normalized, like "base64", "7bit" by default
+	// Disposition is the lower case Content-Disposition, like "inline" or
+	// "attachment", or empty.
+	Disposition       string
+	DispositionParams map[string]string
+
+	Depth int // 0 for the message, 1 for its parts, and so on
+}
+
+// Part is a part of a parsed message, or the whole message. A multipart
+// part has its parts in Parts, and a message/rfc822 part has the message
+// it encloses in Message.
+type Part struct {
+	PartHeader
+
+	Parts   []*Part
+	Message *Message
+
+	body []byte // still transfer encoded, empty for multiparts
+}
+
+// maxPartDepth bounds the nesting of parts, so that a crafted message can
+// not exhaust the stack.
+const maxPartDepth = 100
+
+// Parse reads a whole message into a tree of parts. The bodies are kept
+// transfer encoded until they are read.
+func Parse(r io.Reader) (m *Message, err error) {
+	return ParseWithOptions(r, nil)
+}
+
+// ParseWithOptions is like Parse, decoding header fields and bodies with
+// opts. Parameter values with encoded-words in them, like file names, are
+// decoded while parsing.
+func ParseWithOptions(r io.Reader, opts *DecodeOptions) (m *Message, err error) {
+	return parseMessage(r, opts, 0)
+}
+
+var errNestedTooDeep = errors.New("mail: parts are nested too deep")
+
+func parseMessage(r io.Reader, opts *DecodeOptions, depth int) (m *Message, err error) {
+	br := bufio.NewReader(r)
+	var header textproto.MIMEHeader
+	if header, err = readMessageHeader(br); err != nil {
+		return
+	}
+	var p *Part
+	if p, err = parsePart(header, br, "text/plain", opts, depth); err != nil {
+		return
+	}
+	m = &Message{Part: p}
+	return
+}
+
+func readMessageHeader(br *bufio.Reader) (header textproto.MIMEHeader, err error) {
+	header, err = textproto.NewReader(br).ReadMIMEHeader()
+	if err == io.EOF && len(header) > 0 {
+		// a message without a body
+		err = nil
+	}
+	return
+}
+
+func parsePart(header textproto.MIMEHeader, body io.Reader, defaultType string, opts *DecodeOptions, depth int) (p *Part, err error) {
+	if depth > maxPartDepth {
+		return nil, errNestedTooDeep
+	}
+	p = &Part{PartHeader: *newPartHeader(header, defaultType, opts, depth)}
+
+	switch {
+	case p.boundary() != "":
+		mr := newMultipartReader(body, p.boundary())
+		for {
+			var h textproto.MIMEHeader
+			var partBody io.Reader
+			if h, partBody, err = mr.nextPart(); err == io.EOF {
+				return p, nil
+			}
+			if err != nil {
+				return
+			}
+			var child *Part
+			if child, err = parsePart(h, partBody, p.childType(), opts, depth+1); err != nil {
+				return
+			}
+			p.Parts = append(p.Parts, child)
+		}
+	case p.isMessage():
+		if p.body, err = ioutil.ReadAll(body); err != nil {
+			return
+		}
+		var r io.Reader
+		if r, err = p.DecodedReader(); err != nil {
+			return
+		}
+		p.Message, err = parseMessage(r, opts, depth+1)
+	default:
+		p.body, err = ioutil.ReadAll(body)
+	}
+	return
+}
+
+func newPartHeader(header textproto.MIMEHeader, defaultType string, opts *DecodeOptions, depth int) (ph *PartHeader) {
+	ph = &PartHeader{
+		Header:           Header{MIMEHeader: header, opts: opts},
+		TransferEncoding: NormalizeTransferEncoding(header.Get("Content-Transfer-Encoding")),
+		Depth:            depth,
+	}
+	ph.ContentType, ph.Params = parseMediaField(header.Get("Content-Type"), opts)
+	if ph.ContentType == "" {
+		ph.ContentType = defaultType
+	}
+	ph.Disposition, ph.DispositionParams = parseMediaField(header.Get("Content-Disposition"), opts)
+	return
+}
+
+// boundary returns the boundary of a multipart part, or empty.
+func (ph *PartHeader) boundary() string {
+	if !strings.HasPrefix(ph.ContentType, "multipart/") {
+		return ""
+	}
+	return ph.Params["boundary"]
+}
+
+// isMessage reports whether the part encloses a message.
+func (ph *PartHeader) isMessage() bool {
+	return ph.ContentType == "message/rfc822" || ph.ContentType == "message/global"
+}
+
+// childType is the default content type of the parts of a multipart,
+// RFC 2046 section 5.1.5.
+func (ph *PartHeader) childType() string {
+	if ph.ContentType == "multipart/digest" {
+		return "message/rfc822"
+	}
+	return "text/plain"
+}
+
+// parseMediaField parses Content-Type or Content-Disposition. Of a value
+// mime.ParseMediaType rejects, the media type before the parameters is
+// still used.
+func parseMediaField(value string, opts *DecodeOptions) (mediatype string, params map[string]string) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	mediatype, params, err := mime.ParseMediaType(string(opts.decode8bit([]byte(value))))
+	if err != nil && mediatype == "" {
+		mediatype = strings.ToLower(strings.TrimSpace(strings.SplitN(value, ";", 2)[0]))
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	decodeParamValues(params, opts)
+	return
+}
+
+// Charset returns the lower case charset parameter, or empty.
+func (ph *PartHeader) Charset() string {
+	return strings.ToLower(ph.Params["charset"])
+}
+
+// Filename returns the filename of Content-Disposition, or else the name
+// of Content-Type that older mailers use.
+func (ph *PartHeader) Filename() string {
+	if name := ph.DispositionParams["filename"]; name != "" {
+		return name
+	}
+	return ph.Params["name"]
+}
+
+// DecodedReader returns body, the raw body of the part, with the transfer
+// encoding decoded, for binary content like attachments.
+func (ph *PartHeader) DecodedReader(body io.Reader) (r io.Reader, err error) {
+	return transferDecoder(ph.TransferEncoding, body, ph.Header.opts)
+}
+
+// UTF8Reader returns body, the raw body of the part, decoded to UTF-8
+// from its charset, for text.
+func (ph *PartHeader) UTF8Reader(body io.Reader) (r io.Reader, err error) {
+	return BodyReaderWithOptions(ph.Charset(), ph.TransferEncoding, body, ph.Header.opts)
+}
+
+// RawReader returns the body as it is in the message, still transfer encoded.
+func (p *Part) RawReader() io.Reader {
+	return bytes.NewReader(p.body)
+}
+
+// DecodedReader is PartHeader.DecodedReader of the body of the part.
+func (p *Part) DecodedReader() (r io.Reader, err error) {
+	return p.PartHeader.DecodedReader(p.RawReader())
+}
+
+// UTF8Reader is PartHeader.UTF8Reader of the body of the part.
+func (p *Part) UTF8Reader() (r io.Reader, err error) {
+	return p.PartHeader.UTF8Reader(p.RawReader())
+}
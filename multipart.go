@@ -0,0 +1,162 @@
+package mimemail
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+)
+
+// multipartReader splits a multipart body, RFC 2046 section 5.1, into its
+// parts as they are read, without buffering them. Unlike mime/multipart it
+// leaves the transfer encoding of the parts alone, and it accepts what
+// mailers get wrong: whitespace after a boundary, bare LF line breaks and
+// a missing close delimiter.
+type multipartReader struct {
+	r            *bufio.Reader
+	dashBoundary []byte
+	part         *partBody // the preamble before the first part
+	atLineStart  bool
+	seen         bool // a boundary was seen
+	done         bool // the close delimiter or the end of the input was seen
+}
+
+func newMultipartReader(r io.Reader, boundary string) (mr *multipartReader) {
+	mr = &multipartReader{
+		r:            bufio.NewReader(r),
+		dashBoundary: []byte("--" + boundary),
+		atLineStart:  true,
+	}
+	mr.part = &partBody{mr: mr}
+	return
+}
+
+// nextPart skips what is left of the current part and returns the header
+// and body of the next one, or io.EOF after the last.
+func (mr *multipartReader) nextPart() (header textproto.MIMEHeader, body io.Reader, err error) {
+	if err = mr.part.skip(); err != nil {
+		return
+	}
+	if mr.done {
+		if !mr.seen {
+			err = fmt.Errorf("mail: multipart boundary %q not found", mr.dashBoundary[2:])
+			return
+		}
+		err = io.EOF
+		return
+	}
+
+	header, err = textproto.NewReader(mr.r).ReadMIMEHeader()
+	if err == io.EOF {
+		// a header at the end of a truncated message
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	mr.atLineStart = true
+	mr.part = &partBody{mr: mr}
+	body = mr.part
+	return
+}
+
+// isBoundary reports whether line is a boundary, and notes whether it is
+// the close delimiter.
+func (mr *multipartReader) isBoundary(line []byte) bool {
+	if !bytes.HasPrefix(line, mr.dashBoundary) {
+		return false
+	}
+	rest := bytes.TrimRight(line[len(mr.dashBoundary):], " \t\r\n")
+	switch string(rest) {
+	case "":
+	case "--":
+		mr.done = true
+	default:
+		return false
+	}
+	mr.seen = true
+	return true
+}
+
+// partBody reads the body of a part up to the next boundary. The line
+// break before a boundary belongs to the boundary, so the line break of
+// every line is held back until the next line is known not to be one.
+type partBody struct {
+	mr    *multipartReader
+	line  []byte // the rest of the current line, in mr.r's buffer
+	eol   []byte // a line break that turned out to be part of the body
+	held  [2]byte
+	nheld int
+	out   [2]byte
+	err   error
+}
+
+func (pb *partBody) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		switch {
+		case len(pb.eol) > 0:
+			m := copy(p[n:], pb.eol)
+			pb.eol = pb.eol[m:]
+			n += m
+		case len(pb.line) > 0:
+			m := copy(p[n:], pb.line)
+			pb.line = pb.line[m:]
+			n += m
+		case n > 0:
+			return
+		case pb.err != nil:
+			return 0, pb.err
+		default:
+			pb.next()
+		}
+	}
+	return
+}
+
+// skip reads past the rest of the body without copying it.
+func (pb *partBody) skip() error {
+	for pb.err == nil {
+		pb.next()
+	}
+	pb.line, pb.eol = nil, nil
+	if pb.err == io.EOF {
+		return nil
+	}
+	return pb.err
+}
+
+// next reads the next line, or as much of it as fits in mr.r's buffer.
+func (pb *partBody) next() {
+	mr := pb.mr
+	atLineStart := mr.atLineStart
+	line, err := mr.r.ReadSlice('\n')
+	mr.atLineStart = err == nil
+
+	if atLineStart && mr.isBoundary(line) {
+		pb.err = io.EOF
+		return
+	}
+
+	copy(pb.out[:], pb.held[:pb.nheld])
+	pb.eol = pb.out[:pb.nheld]
+	pb.nheld = 0
+	switch err {
+	case nil:
+		l := len(line) - 1
+		if l > 0 && line[l-1] == '\r' {
+			l--
+		}
+		pb.nheld = copy(pb.held[:], line[l:])
+		line = line[:l]
+	case bufio.ErrBufferFull:
+	case io.EOF:
+		// no close delimiter
+		mr.done = true
+		pb.err = io.EOF
+	default:
+		mr.done = true
+		pb.err = err
+	}
+	pb.line = line
+}
@@ -3,58 +3,217 @@ package mimemail
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"strconv"
 	"strings"
-)
-
-const (
-	raw int = iota
-	quoteStarting
-	quoteEnding
-	quoteBody
+	"unicode/utf8"
 )
 
 // var (
 // 	CorruptedEncodingError = errors.New("corrupted encoding error")
 // )
 
-var (
-	encodedWordStart = []byte("=?")
-	encodedWordEnd   = []byte("?=")
-)
+var encodedWordStart = []byte("=?")
+
+// DecodeOptions configures how header text is decoded.
+type DecodeOptions struct {
+	UTF8ReaderFactory UTF8ReaderFactory // Defaults to DefaultUTF8ReaderFactory
+
+	// FallbackCharset decodes raw 8-bit text outside of encoded-words that is
+	// not valid UTF-8, usually the charset of the message body.
+	FallbackCharset string
+	// DetectCharset guesses the charset of such text when there is no
+	// FallbackCharset or it is not supported.
+	DetectCharset bool
+
+	// Tolerant keeps decoding when an encoded-word can not be decoded, for
+	// example because of an unsupported charset. The word is decoded with
+	// FallbackCharset if there is one, or else left as it was, and the
+	// problem is added to the reader's Warnings.
+	Tolerant bool
+
+	// Lenient recognises encoded-words that are not delimited by whitespace
+	// as RFC 2047 requires, like "Re:=?utf-8?q?x?=" or "(=?utf-8?q?x?=)".
+	Lenient bool
+
+	// Lookahead bounds how far RFC2047Reader reads ahead to validate an
+	// encoded-word, defaults to DefaultLookahead.
+	Lookahead int
+
+	// Diagnostics receives reports of non-standard constructs, like raw
+	// 8-bit text or unsupported charsets.
+	Diagnostics Diagnostics
+}
+
+func (opts *DecodeOptions) diagnostics() Diagnostics {
+	if opts == nil {
+		return nil
+	}
+	return opts.Diagnostics
+}
+
+func (opts *DecodeOptions) utf8ReaderFactory() UTF8ReaderFactory {
+	if opts == nil || opts.UTF8ReaderFactory == nil {
+		return &DefaultUTF8ReaderFactory{}
+	}
+	return opts.UTF8ReaderFactory
+}
+
+// decode8bit converts raw 8-bit header text to UTF-8 with the fallback or
+// detected charset. Text that is already valid UTF-8 is left alone, and so is
+// everything when no charset is configured.
+func (opts *DecodeOptions) decode8bit(b []byte) []byte {
+	if opts == nil || !has8bit(b) {
+		return b
+	}
+	if utf8.Valid(b) {
+		report(opts.Diagnostics, EightBitHeader, string(b), "utf-8", nil)
+		return b
+	}
+
+	var charsets []string
+	if opts.FallbackCharset != "" {
+		charsets = append(charsets, strings.ToLower(opts.FallbackCharset))
+	}
+	if opts.DetectCharset {
+		if detected, _ := DetectCharset(b); detected != "" {
+			charsets = append(charsets, detected)
+		}
+	}
+
+	factory := opts.utf8ReaderFactory()
+	for _, charset := range charsets {
+		r, err := factory.UTF8Reader(charset, bytes.NewReader(b))
+		if err != nil {
+			report(opts.Diagnostics, UnsupportedCharset, string(b), charset, err)
+			continue
+		}
+		report(opts.Diagnostics, EightBitHeader, string(b), charset, nil)
+		decoded, _ := ioutil.ReadAll(&validUTF8Reader{r: r, charset: charset})
+		return decoded
+	}
+	report(opts.Diagnostics, EightBitHeader, string(b), "", nil)
+	return b
+}
 
 func DecodeText(text string, utf8ReaderFactory UTF8ReaderFactory) (decoded string, err error) {
-	r := NewRFC2047Reader(strings.NewReader(text), utf8ReaderFactory)
+	return DecodeTextWithOptions(text, &DecodeOptions{UTF8ReaderFactory: utf8ReaderFactory})
+}
+
+func DecodeTextWithOptions(text string, opts *DecodeOptions) (decoded string, err error) {
+	r := NewRFC2047ReaderWithOptions(strings.NewReader(text), opts)
 	var b []byte
 	b, err = ioutil.ReadAll(r)
 	decoded = string(b)
 	return
 }
 
+// DecodeTextTolerant decodes text in tolerant mode and returns the problems
+// it worked around as warnings.
+func DecodeTextTolerant(text string, opts *DecodeOptions) (decoded string, warnings []error) {
+	tolerant := DecodeOptions{}
+	if opts != nil {
+		tolerant = *opts
+	}
+	tolerant.Tolerant = true
+
+	r := NewRFC2047ReaderWithOptions(strings.NewReader(text), &tolerant)
+	b, err := ioutil.ReadAll(r)
+	warnings = r.Warnings
+	if err != nil {
+		warnings = append(warnings, err)
+	}
+	decoded = string(b)
+	return
+}
+
+// Segment is a piece of decoded header text: a run of raw text, or one
+// encoded-word or several joined ones.
+type Segment struct {
+	Raw      string // The text as it is in the header
+	Encoded  bool
+	Charset  string // Charset, encoding and language of the (first) encoded-word
+	Encoding string
+	Language string
+	Text     string // The decoded text, empty for whitespace dropped between encoded-words
+	Err      error  // Why the encoded-word could not be decoded, if it could not
+}
+
+// DecodeTextSegments decodes text like DecodeTextWithOptions, but returns it
+// in segments whose Text concatenates to the decoded text. In tolerant mode
+// undecodable words are segments with Err set, otherwise decoding stops at
+// the first of them with err, and the segment has no Text.
+func DecodeTextSegments(text string, opts *DecodeOptions) (segments []Segment, err error) {
+	r := NewRFC2047ReaderWithOptions(strings.NewReader(text), opts)
+	r.recordSegments = true
+	_, err = ioutil.ReadAll(r)
+	segments = r.segments
+	return
+}
+
+// DefaultLookahead is how many bytes RFC2047Reader looks ahead by default.
+// An encoded-word must fit in the lookahead to be recognised.
+const DefaultLookahead = 4096
+
+// minLookahead leaves room for the longest encoded-word and the byte after it.
+const minLookahead = maxEncodedWordLen + 2
+
+// RFC2047Reader decodes the encoded-words in header text. It reads the text
+// token by token: runs of raw text, linear whitespace, and encoded-words,
+// which are validated within the lookahead before they are decoded.
 type RFC2047Reader struct {
 	br                *bufio.Reader
-	state             int
+	lookahead         int
+	opts              *DecodeOptions
 	utf8ReaderFactory UTF8ReaderFactory
 	buf               *bytes.Buffer
 	err               error
-	bodyReader        io.Reader
-	charsetBytes      []byte
-	encodingBytes     []byte
+	prev              int  // last raw byte, -1 at the start of the text
+	afterWord         bool // an encoded-word was just decoded
+	pendingSpace      []byte
+	pendingCharset    string // charset of the encoded-words to be joined
+	pendingBytes      []byte
+	pendingWords      []byte
+	pendingWord       *EncodedWord // first of the encoded-words to be joined
+	recordSegments    bool
+	qd                *QDecoder
+	bd                *Base64Decoder
+	segments          []Segment
+	Warnings          []error        // Problems skipped in tolerant mode
+	Words             []*EncodedWord // The encoded-words read so far
+}
+
+// EncodedWord describes an encoded-word read by RFC2047Reader.
+type EncodedWord struct {
+	Charset  string
+	Language string // RFC 2231 language tag, like "ja" in =?utf-8*ja?B?...?=
+	Encoding string
 }
 
 func NewRFC2047Reader(r io.Reader, utf8ReaderFactory UTF8ReaderFactory) *RFC2047Reader {
-	if utf8ReaderFactory == nil {
-		utf8ReaderFactory = &DefaultUTF8ReaderFactory{}
+	return NewRFC2047ReaderWithOptions(r, &DecodeOptions{UTF8ReaderFactory: utf8ReaderFactory})
+}
+
+func NewRFC2047ReaderWithOptions(r io.Reader, opts *DecodeOptions) *RFC2047Reader {
+	if opts == nil {
+		opts = &DecodeOptions{}
+	}
+	lookahead := opts.Lookahead
+	if lookahead == 0 {
+		lookahead = DefaultLookahead
+	}
+	if lookahead < minLookahead {
+		lookahead = minLookahead
 	}
 
 	return &RFC2047Reader{
-		br:                bufio.NewReaderSize(r, 256),
-		state:             raw,
-		utf8ReaderFactory: utf8ReaderFactory,
+		br:                bufio.NewReaderSize(r, lookahead),
+		lookahead:         lookahead,
+		prev:              -1,
+		opts:              opts,
+		utf8ReaderFactory: opts.utf8ReaderFactory(),
 		buf:               bytes.NewBuffer(nil),
 	}
 }
@@ -62,221 +221,597 @@ func NewRFC2047Reader(r io.Reader, utf8ReaderFactory UTF8ReaderFactory) *RFC2047
 // =?utf-8?B?SGVsbG8gUERGIOWKoOeCueS4reaWh+WSjOaXpeacrOiqnuOBig==?=
 // =?utf-8?B?44Gv44KI44GG44GU44GW44GE44G+44GZ?=
 func (rr *RFC2047Reader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for rr.buf.Len() == 0 && rr.err == nil {
+		rr.err = rr.next()
+	}
+	if rr.buf.Len() > 0 {
+		return rr.buf.Read(p)
+	}
+	return 0, rr.err
+}
+
+// next decodes the token at the start of the input into rr.buf.
+// Linear whitespace between two encoded-words is discarded,
+// anywhere else it is kept.
+func (rr *RFC2047Reader) next() (err error) {
+	peek, peekErr := rr.br.Peek(rr.lookahead)
+	atEOF := peekErr != nil
 
-	// fmt.Println(rr.state)
+	if len(peek) == 0 {
+		if err = rr.flushWords(); err != nil {
+			return
+		}
+		// whitespace after the last encoded-word is kept
+		rr.write(rr.pendingSpace, rr.pendingSpace, nil, nil)
+		rr.pendingSpace = nil
+		return peekErr
+	}
 
-	l := len(p)
+	if rr.afterWord {
+		if ws := whitespaceLen(peek); ws > 0 {
+			rr.pendingSpace = append(rr.pendingSpace, peek[:ws]...)
+			rr.br.Discard(ws)
+			return
+		}
+		rr.afterWord = false
 
-	if l == 0 {
-		return 0, nil
+		prev := int('=')
+		if len(rr.pendingSpace) > 0 {
+			prev = int(rr.pendingSpace[len(rr.pendingSpace)-1])
+		}
+		if start, isWord := rr.findWord(peek, prev, atEOF); start == 0 && isWord {
+			// the whitespace is dropped by addWord
+			return rr.decodeWord(peek)
+		}
+		if err = rr.flushWords(); err != nil {
+			return
+		}
+		rr.write(rr.pendingSpace, rr.pendingSpace, nil, nil)
+		rr.pendingSpace = rr.pendingSpace[:0]
+		rr.prev = prev
 	}
 
-	if rr.buf.Len() > l {
-		return rr.buf.Read(p)
+	start, isWord := rr.findWord(peek, rr.prev, atEOF)
+	if start == 0 && isWord {
+		return rr.decodeWord(peek)
 	}
 
-	// underline reader have error, but still have buffer
-	if rr.err != nil && rr.buf.Len() < l {
-		n, _ = rr.buf.Read(p)
-		err = rr.err
-		return
+	nCopy := start
+	if start == -1 {
+		nCopy = len(peek)
+		// leave the last byte, it may start an "=?", and don't cut
+		// raw 8-bit text in the middle of a character
+		if !atEOF {
+			if i := lastASCII(peek[:len(peek)-1]); i >= 0 {
+				nCopy = i + 1
+			}
+		}
 	}
+	rr.write(peek[:nCopy], rr.opts.decode8bit(peek[:nCopy]), nil, nil)
+	rr.prev = int(peek[nCopy-1])
+	rr.br.Discard(nCopy)
+	return
+}
 
-	peek, _ := rr.br.Peek(256)
+// decodeWord decodes the validated encoded-word at the start of peek.
+func (rr *RFC2047Reader) decodeWord(peek []byte) (err error) {
+	l, _ := encodedWordLen(peek, rr.opts.Lenient)
+	word := peek[:l]
+
+	q1 := 2 + bytes.IndexByte(word[2:], '?')
+	q2 := q1 + 2
+	charset := string(word[2:q1])
+	encoding := word[q1+1 : q2]
+	text := word[q2+1 : l-2]
+
+	// RFC 2231 section 5 allows a language after the charset: =?utf-8*ja?B?...?=
+	var language string
+	if i := strings.IndexByte(charset, '*'); i != -1 {
+		charset, language = charset[:i], charset[i+1:]
+	}
+	ew := &EncodedWord{Charset: charset, Language: language, Encoding: string(encoding)}
+	rr.Words = append(rr.Words, ew)
 
-	if len(peek) == 0 {
-		return rr.setErrAndReadLeft(io.EOF, p)
+	// words are only joined within a segment of one charset and language
+	if len(rr.pendingWords) > 0 && (!strings.EqualFold(rr.pendingCharset, charset) || !strings.EqualFold(rr.pendingWord.Language, language)) {
+		if err = rr.flushWords(); err != nil {
+			return
+		}
 	}
+	err = rr.addWord(word, ew, encoding, text)
+	rr.br.Discard(l)
+	rr.afterWord = true
+	return
+}
 
-	// spaces newlines between two encoded-word are discarded
-	// but spaces and newlines between encoded-word and raw word are not
+// addWord transfer-decodes an encoded-word. Its bytes are kept until the
+// next token shows whether another word in the same charset follows, so
+// that characters and charset state spanning words survive.
+func (rr *RFC2047Reader) addWord(word []byte, ew *EncodedWord, encoding []byte, text []byte) (err error) {
+	var decoded []byte
+	if decoded, err = rr.decodeWordText(encoding, text); err != nil {
+		if ferr := rr.flushWords(); ferr != nil {
+			return ferr
+		}
+		rr.dropSpace()
+		if !rr.opts.Tolerant {
+			rr.write(word, nil, ew, err)
+			return
+		}
+		werr := &EncodedWordError{Word: string(word), Err: err}
+		rr.Warnings = append(rr.Warnings, werr)
+		rr.write(word, word, ew, werr)
+		return nil
+	}
 
-	if rr.state == raw {
+	if len(rr.pendingWords) > 0 {
+		rr.pendingWords = append(rr.pendingWords, rr.pendingSpace...)
+		rr.pendingSpace = rr.pendingSpace[:0]
+	} else {
+		rr.dropSpace()
+		rr.pendingWord = ew
+	}
+	rr.pendingWords = append(rr.pendingWords, word...)
+	rr.pendingCharset = ew.Charset
+	rr.pendingBytes = append(rr.pendingBytes, decoded...)
+	return
+}
 
-		startIndex := bytes.Index(peek, encodedWordStart)
-		nCopy := 0
-		if startIndex == -1 {
-			nCopy = len(peek)
-		} else {
-			nCopy = startIndex
-			rr.state = quoteStarting
+// decodeWordText decodes the encoded-text of an encoded-word with decoders
+// that are kept for the next word.
+func (rr *RFC2047Reader) decodeWordText(encoding []byte, text []byte) (decoded []byte, err error) {
+	if encoding[0] == 'q' || encoding[0] == 'Q' {
+		if rr.qd == nil {
+			rr.qd = &QDecoder{IsHeader: true, Diagnostics: rr.opts.Diagnostics}
 		}
+		rr.qd.out = rr.qd.out[:0]
+		err = rr.qd.decodeLine(text, true)
+		return rr.qd.out, err
+	}
+	if rr.bd == nil {
+		rr.bd = &Base64Decoder{Diagnostics: rr.opts.Diagnostics}
+	}
+	return rr.bd.decodeAll(text)
+}
 
-		if strings.Trim(string(peek[0:nCopy]), "\r\n ") != "" {
-			if _, err = io.CopyN(rr.buf, rr.br, int64(nCopy)); err != nil {
-				return rr.setErrAndReadLeft(err, p)
+// dropSpace discards the whitespace between two encoded-words that are
+// not joined.
+func (rr *RFC2047Reader) dropSpace() {
+	rr.write(rr.pendingSpace, nil, nil, nil)
+	rr.pendingSpace = rr.pendingSpace[:0]
+}
+
+// write writes the decoded text of a token, and records it as a Segment
+// when the reader is used by DecodeTextSegments. word is nil for raw text.
+func (rr *RFC2047Reader) write(raw []byte, text []byte, word *EncodedWord, err error) {
+	rr.buf.Write(text)
+	if !rr.recordSegments || len(raw) == 0 {
+		return
+	}
+	if word == nil && len(text) > 0 {
+		if n := len(rr.segments); n > 0 {
+			last := &rr.segments[n-1]
+			if !last.Encoded && last.Text != "" {
+				last.Raw += string(raw)
+				last.Text += string(text)
+				return
 			}
-		} else {
-			discard := make([]byte, nCopy)
-			rr.br.Read(discard)
 		}
+	}
+	s := Segment{Raw: string(raw), Text: string(text), Err: err}
+	if word != nil {
+		s.Encoded = true
+		s.Charset, s.Encoding, s.Language = word.Charset, word.Encoding, word.Language
+	}
+	rr.segments = append(rr.segments, s)
+}
 
-		return rr.Read(p)
+// flushWords writes the joined bytes of the pending encoded-words through
+// the charset decoder. In tolerant mode words that fail to decode are
+// recorded in rr.Warnings and decoded with the fallback charset, or else
+// written as they were.
+func (rr *RFC2047Reader) flushWords() (err error) {
+	if len(rr.pendingWords) == 0 {
+		return
+	}
+	words, b := rr.pendingWords, rr.pendingBytes
+	rr.pendingWords, rr.pendingBytes = rr.pendingWords[:0], rr.pendingBytes[:0]
 
+	var decoded []byte
+	if decoded, err = rr.decodeCharset(rr.pendingCharset, words, b); err == nil {
+		rr.write(words, decoded, rr.pendingWord, nil)
+		return
+	}
+	if !rr.opts.Tolerant {
+		rr.write(words, nil, rr.pendingWord, err)
+		return
 	}
 
-	if rr.state == quoteEnding {
-		drop := make([]byte, 2)
-		// drop "?="
-		if _, err = rr.br.Read(drop); err != nil {
-			return rr.setErrAndReadLeft(err, p)
+	werr := &EncodedWordError{Word: string(words), Err: err}
+	rr.Warnings = append(rr.Warnings, werr)
+	if fallback := rr.opts.FallbackCharset; fallback != "" {
+		if decoded, err = rr.decodeCharset(fallback, words, b); err == nil {
+			rr.write(words, decoded, rr.pendingWord, werr)
+			return
 		}
-		rr.state = raw
-		return rr.Read(p)
 	}
+	rr.write(words, words, rr.pendingWord, werr)
+	return nil
+}
+
+// decodeCharset decodes b, the bytes of the encoded-words words, from charset.
+func (rr *RFC2047Reader) decodeCharset(charset string, words []byte, b []byte) (decoded []byte, err error) {
+	var r io.Reader
+	br := bytes.NewReader(b)
+	if r, err = rr.utf8ReaderFactory.UTF8Reader(strings.ToLower(charset), br); err != nil {
+		report(rr.opts.Diagnostics, UnsupportedCharset, string(words), charset, err)
+		return
+	}
+	if r == io.Reader(br) {
+		// utf-8 is not decoded
+		return b, nil
+	}
+	return ioutil.ReadAll(r)
+}
+
+// EncodedWordError is a problem with one encoded-word, reported instead of
+// failing by a tolerant RFC2047Reader.
+type EncodedWordError struct {
+	Word string
+	Err  error
+}
+
+func (e *EncodedWordError) Error() string {
+	return fmt.Sprintf("mail: can not decode %s: %v", e.Word, e.Err)
+}
 
-	if rr.state == quoteBody {
-		endIndex := bytes.Index(peek, encodedWordEnd)
-		nCopy := 0
-		if endIndex == -1 {
-			nCopy = len(peek)
-		} else {
-			nCopy = endIndex
-			rr.state = quoteEnding
+func lastASCII(b []byte) int {
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0x80 {
+			return i
 		}
+	}
+	return -1
+}
 
-		rr.bodyReader, err = bodyReader(rr.charsetBytes, rr.encodingBytes, io.LimitReader(rr.br, int64(nCopy)), rr.utf8ReaderFactory, true)
-		if err != nil {
-			return rr.setErrAndReadLeft(err, p)
+// findWord returns the index of the first encoded-word in peek. prev is the
+// byte before peek, or -1 at the start of the text. If isWord is false the
+// bytes from start on need a fresh peek to tell if they are an encoded-word.
+func (rr *RFC2047Reader) findWord(peek []byte, prev int, atEOF bool) (start int, isWord bool) {
+	for offset := 0; ; {
+		i := bytes.Index(peek[offset:], encodedWordStart)
+		if i == -1 {
+			return -1, false
 		}
+		start = offset + i
+		offset = start + 1
 
-		if _, err = io.Copy(rr.buf, rr.bodyReader); err != nil && err != io.EOF {
-			return rr.setErrAndReadLeft(err, p)
+		if start > 0 {
+			prev = int(peek[start-1])
+		}
+		if !rr.opts.Lenient && prev != -1 && !isWhitespace(byte(prev)) {
+			continue
 		}
 
-		return rr.Read(p)
-	}
+		l, complete := encodedWordLen(peek[start:], rr.opts.Lenient)
+		if !complete {
+			if atEOF || start == 0 {
+				continue
+			}
+			// might be cut by the peek
+			return start, false
+		}
+		if l == -1 {
+			continue
+		}
 
-	if rr.state == quoteStarting {
-		// drop "=?"
-		drop := make([]byte, 2)
-		rr.br.Read(drop)
+		end := start + l
+		if end == len(peek) && !atEOF && start > 0 {
+			return start, false
+		}
+		if end < len(peek) && !rr.opts.Lenient && !isWhitespace(peek[end]) {
+			continue
+		}
+		return start, true
+	}
+}
 
-		rr.charsetBytes, err = rr.br.ReadBytes('?')
-		if err != nil {
-			return rr.setErrAndReadLeft(err, p)
+// maxEncodedWordLen is the longest encoded-word accepted when not lenient.
+// RFC 2047 allows 75 characters, but Japanese mailers often write longer
+// words, so only text that can not be a real encoded-word is refused.
+const maxEncodedWordLen = 200
+
+// encodedWordLen validates the =?charset?encoding?encoded-text?= at the start
+// of b and returns its length, or -1 if it is not an encoded-word. complete
+// is false if b ends before that can be told. Lenient accepts words that are
+// too long or have no encoded-text.
+func encodedWordLen(b []byte, lenient bool) (l int, complete bool) {
+	const (
+		charset = iota
+		encoding
+		text
+	)
+	part := charset
+	partStart := 2
+	for i := 2; ; i++ {
+		if !lenient && i > maxEncodedWordLen {
+			return -1, true
 		}
-		rr.charsetBytes = rr.charsetBytes[0 : len(rr.charsetBytes)-1] // cut ?
+		if i >= len(b) {
+			return -1, false
+		}
+		c := b[i]
 
-		rr.encodingBytes, err = rr.br.ReadBytes('?')
-		if err != nil {
-			return rr.setErrAndReadLeft(err, p)
+		switch part {
+		case charset:
+			if c == '?' {
+				if i == partStart {
+					return -1, true
+				}
+				part, partStart = encoding, i+1
+				continue
+			}
+			if !isTokenChar(c) {
+				return -1, true
+			}
+		case encoding:
+			if i == partStart {
+				switch c {
+				case 'b', 'B', 'q', 'Q':
+					continue
+				}
+				return -1, true
+			}
+			if c != '?' {
+				return -1, true
+			}
+			part, partStart = text, i+1
+		case text:
+			if c == '?' {
+				if i+1 >= len(b) {
+					return -1, false
+				}
+				if b[i+1] != '=' || (i == partStart && !lenient) {
+					return -1, true
+				}
+				l = i + 2
+				if !lenient && l > maxEncodedWordLen {
+					return -1, true
+				}
+				return l, true
+			}
+			if c <= ' ' || c > '~' {
+				return -1, true
+			}
 		}
-		rr.encodingBytes = rr.encodingBytes[0 : len(rr.encodingBytes)-1] // cut ?
+	}
+}
 
-		rr.state = quoteBody
-		return rr.Read(p)
+// isTokenChar reports whether c may appear in the charset of an
+// encoded-word: any CHAR except SPACE, CTLs and especials.
+func isTokenChar(c byte) bool {
+	if c <= ' ' || c > '~' {
+		return false
 	}
-	return
+	return strings.IndexByte(`()<>@,;:"/[]?.=`, c) == -1
 }
 
-func (rr *RFC2047Reader) setErrAndReadLeft(e error, p []byte) (n int, err error) {
-	rr.err = e
-	return rr.Read(p)
+func isWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
 }
 
-func BodyReader(charset string, encoding string, r io.Reader, utf8ReaderFactory UTF8ReaderFactory) (br io.Reader, err error) {
-	if utf8ReaderFactory == nil {
-		utf8ReaderFactory = &DefaultUTF8ReaderFactory{}
+func whitespaceLen(b []byte) int {
+	i := 0
+	for i < len(b) && isWhitespace(b[i]) {
+		i++
 	}
-	return bodyReader([]byte(charset), []byte(encoding), r, utf8ReaderFactory, false)
+	return i
 }
 
-func bodyReader(charsetBytes []byte, encBytes []byte, r io.Reader, utf8ReaderFactory UTF8ReaderFactory, isHeader bool) (br io.Reader, err error) {
-
-	encoding := strings.ToLower(string(encBytes))
-	charset := strings.ToLower(string(charsetBytes))
+func BodyReader(charset string, encoding string, r io.Reader, utf8ReaderFactory UTF8ReaderFactory) (br io.Reader, err error) {
+	return BodyReaderWithOptions(charset, encoding, r, &DecodeOptions{UTF8ReaderFactory: utf8ReaderFactory})
+}
 
-	switch encoding {
-	case "q", "quoted-printable":
-		br = NewQDecoder(r, isHeader)
-	case "b", "base64":
-		br = base64.NewDecoder(base64.StdEncoding, NewLineLessReader(r))
-	default:
-		br = r
+// BodyReaderWithOptions is like BodyReader, using the UTF8ReaderFactory and
+// Diagnostics of opts. An encoding that is not registered is an
+// *UnknownTransferEncodingError, in tolerant mode it is reported and the
+// body is read as it is.
+func BodyReaderWithOptions(charset string, encoding string, r io.Reader, opts *DecodeOptions) (br io.Reader, err error) {
+	if r, err = transferDecoder(encoding, r, opts); err != nil {
+		return
+	}
+	charset = strings.ToLower(charset)
+	br, err = opts.utf8ReaderFactory().UTF8Reader(charset, r)
+	if err != nil {
+		report(opts.diagnostics(), UnsupportedCharset, charset, charset, err)
 	}
-	br, err = utf8ReaderFactory.UTF8Reader(charset, br)
 	return
 }
 
+// QDecoder decodes quoted-printable, RFC 2045 section 6.7, and the "Q"
+// encoding of encoded-words when IsHeader is set. By default it is lenient
+// like mainstream mail clients: invalid escapes are kept as they are, lower
+// case hex is accepted and an "=" at the end of the text is ignored.
 type QDecoder struct {
-	r        *bufio.Reader
-	buf      *bytes.Buffer
-	err      error
-	isEql    bool
-	eqlCode  []byte
+	r    *bufio.Reader
+	out  []byte // decoded, from pos on not read yet
+	pos  int
+	err  error
+	line []byte // the line being read
+
 	IsHeader bool
+	// Strict fails on anything RFC 2045 does not allow: invalid or lower
+	// case escapes, and an "=" at the end of the text.
+	Strict bool
+
+	Diagnostics Diagnostics // Receives invalid escapes
 }
 
 func NewQDecoder(r io.Reader, isHeader bool) (rd *QDecoder) {
-	rd = &QDecoder{r: bufio.NewReader(r), buf: bytes.NewBuffer(nil), IsHeader: isHeader}
+	rd = &QDecoder{r: bufio.NewReader(r), IsHeader: isHeader}
 	return
 }
 
-func (qd *QDecoder) reset() {
-	qd.isEql = false
-	qd.eqlCode = nil
-}
-
 func (qd *QDecoder) Read(p []byte) (n int, err error) {
-	// This method writes at most one byte into p.
 	if len(p) == 0 {
 		return 0, nil
 	}
-
-	if qd.buf.Len() >= len(p) {
-		return qd.buf.Read(p)
+	for qd.pos == len(qd.out) && qd.err == nil {
+		qd.out, qd.pos = qd.out[:0], 0
+		qd.err = qd.readLine()
 	}
-
-	if qd.err != nil {
-		n, _ = qd.buf.Read(p)
-		err = qd.err
+	if qd.pos < len(qd.out) {
+		n = copy(p, qd.out[qd.pos:])
+		qd.pos += n
 		return
 	}
+	return 0, qd.err
+}
 
-	readBytes := make([]byte, 512)
-	n, qd.err = qd.r.Read(readBytes)
-	for i := 0; i < n; i++ {
-		c := readBytes[i]
-		if qd.isEql {
-			if c == '\n' || c == '\r' {
-				qd.reset()
-				continue
+// WriteTo writes the decoded text to w a line at a time.
+func (qd *QDecoder) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		if qd.pos < len(qd.out) {
+			m, werr := w.Write(qd.out[qd.pos:])
+			n += int64(m)
+			qd.pos += m
+			if werr != nil {
+				return n, werr
 			}
-			if len(qd.eqlCode) < 2 {
-				qd.eqlCode = append(qd.eqlCode, c)
+		}
+		if qd.err != nil {
+			if qd.err != io.EOF {
+				err = qd.err
 			}
-			if len(qd.eqlCode) == 2 {
-				x, err := strconv.ParseInt(string(qd.eqlCode), 16, 64)
-				if err != nil {
-					return 0, fmt.Errorf("mail: invalid RFC 2047 encoding: %q", qd.eqlCode)
-				}
-				qd.buf.WriteByte(byte(x))
-				qd.reset()
+			return
+		}
+		qd.out, qd.pos = qd.out[:0], 0
+		qd.err = qd.readLine()
+	}
+}
+
+// readLine decodes the next line into qd.out, straight from the buffer of
+// qd.r. A line longer than the buffer is decoded in pieces, holding back
+// what may be trailing whitespace, a soft line break or a cut escape.
+func (qd *QDecoder) readLine() (err error) {
+	if qd.out == nil {
+		qd.out = make([]byte, 0, qd.r.Size())
+	}
+	var chunk []byte
+	chunk, err = qd.r.ReadSlice('\n')
+	line := chunk
+	if len(qd.line) > 0 || err == bufio.ErrBufferFull {
+		qd.line = append(qd.line, chunk...)
+		line = qd.line
+	}
+
+	switch err {
+	case nil, io.EOF:
+		if len(line) > 0 || err == nil {
+			if derr := qd.decodeLine(line, err == io.EOF); derr != nil {
+				err = derr
 			}
-			continue
 		}
+		qd.line = qd.line[:0]
+		return
+	case bufio.ErrBufferFull:
+		cut := len(qd.line)
+		for cut > 0 && (qd.line[cut-1] == ' ' || qd.line[cut-1] == '\t' || qd.line[cut-1] == '=') {
+			cut--
+		}
+		if cut >= 2 && qd.line[cut-2] == '=' {
+			cut -= 2
+		}
+		if err = qd.decodeText(qd.line[:cut]); err != nil {
+			return
+		}
+		qd.line = append(qd.line[:0], qd.line[cut:]...)
+		return nil
+	}
+	return
+}
+
+// decodeLine decodes a whole line, with its line break unless it is the
+// last line.
+func (qd *QDecoder) decodeLine(line []byte, last bool) (err error) {
+	text := line
+	var eol []byte
+	if n := len(text); n > 0 && text[n-1] == '\n' {
+		text = text[:n-1]
+		if n > 1 && text[n-2] == '\r' {
+			text = text[:n-2]
+		}
+		eol = line[len(text):]
+	}
+
+	// whitespace at the end of a line was added in transport
+	text = bytes.TrimRight(text, " \t")
+	if n := len(text); n > 0 && text[n-1] == '=' {
+		// soft line break
+		text = text[:n-1]
+		if last && qd.Strict {
+			err = errors.New(`mail: quoted-printable text ends with "="`)
+			report(qd.Diagnostics, InvalidQEscape, "=", "", err)
+			return
+		}
+		eol = nil
+	}
 
-		switch c {
-		case '=':
-			qd.isEql = true
-		case '_':
-			if qd.IsHeader {
-				qd.buf.WriteByte(byte(' '))
-			} else {
-				qd.buf.WriteByte('_')
+	if err = qd.decodeText(text); err != nil {
+		return
+	}
+	if !qd.IsHeader {
+		qd.out = append(qd.out, eol...)
+	}
+	return
+}
+
+func (qd *QDecoder) decodeText(text []byte) (err error) {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '=':
+			if i+2 < len(text) {
+				if x, ok := unhex(text[i+1], qd.Strict); ok {
+					if y, ok := unhex(text[i+2], qd.Strict); ok {
+						qd.out = append(qd.out, x<<4|y)
+						i += 2
+						continue
+					}
+				}
+			}
+			escape := text[i:]
+			if len(escape) > 3 {
+				escape = escape[:3]
 			}
-			qd.reset()
-		case '\n', '\r':
-			if !qd.IsHeader {
-				qd.buf.WriteByte(c)
+			if qd.Strict {
+				err = fmt.Errorf("mail: invalid quoted-printable escape: %q", escape)
+				report(qd.Diagnostics, InvalidQEscape, string(escape), "", err)
+				return
 			}
-			qd.reset()
+			report(qd.Diagnostics, InvalidQEscape, string(escape), "", nil)
+			qd.out = append(qd.out, c)
+		case c == '_' && qd.IsHeader:
+			qd.out = append(qd.out, ' ')
 		default:
-			qd.buf.WriteByte(c)
-			qd.reset()
+			qd.out = append(qd.out, c)
 		}
 	}
+	return
+}
 
-	return qd.Read(p)
+// unhex decodes a hex digit, upper case only if strict.
+func unhex(c byte, strict bool) (x byte, ok bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	case 'a' <= c && c <= 'f' && !strict:
+		return c - 'a' + 10, true
+	}
+	return 0, false
 }
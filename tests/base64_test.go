@@ -0,0 +1,79 @@
+package mimemail
+
+import (
+	"encoding/base64"
+	"github.com/sunfmin/mimemail"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+type base64Case struct {
+	input   string
+	output  string
+	ignored int64
+}
+
+var base64Cases = []base64Case{
+	{"5pel5pys6Kqe\r\n", "日本語", 0},
+	{"5pel\r\n5pys\r\n6Kqe", "日本語", 0},
+	{"5pel 5p-ys6K*qe", "日本語", 2},
+	{"5pel5g", "日\xe6", 0},
+	{"5pel5g=", "日\xe6", 0},
+	{"5pel5g====", "日\xe6", 0},
+	{"5pel5", "日", 1},
+	{"5pel5g==\r\n-- \r\nscanned by x\r\n", "日\xe6", 12},
+	{"5pel5pys6Kqe\r\n\r\n-- \r\nscanned by x\r\n", "日本語", 12},
+	{"5pel5pys6Kqe\n\nscanned\n", "日本語", 7},
+	{"5pel\r\n\r\n5pys6Kqe", "日本語", 0},
+	{"5pel\n\n \n5pys\n\n6Kqe\n\n", "日本語", 0},
+	{"5pel\r\n\r\n5pys\r\n\r\nbye", "日本", 3},
+	{"", "", 0},
+}
+
+var strictBase64Errors = []string{
+	"5pel 5p-ys6Kqe",
+	"5pel5g",
+	"5pel5g==x",
+	"5pel5",
+	"=5pel",
+	"5pel5g===",
+	"5pel5g=",
+}
+
+func TestBase64Decoder(t *testing.T) {
+	for _, c := range base64Cases {
+		bd := mimemail.NewBase64Decoder(iotest.OneByteReader(strings.NewReader(c.input)))
+		b, err := ioutil.ReadAll(bd)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(b) != c.output || bd.Ignored != c.ignored {
+			t.Errorf("%q: expected: %q, %d, but was: %q, %d", c.input, c.output, c.ignored, b, bd.Ignored)
+		}
+	}
+
+	for _, input := range strictBase64Errors {
+		bd := mimemail.NewBase64Decoder(strings.NewReader(input))
+		bd.Strict = true
+		_, err := ioutil.ReadAll(bd)
+		if _, ok := err.(base64.CorruptInputError); !ok {
+			t.Errorf("%q: expected CorruptInputError, but was: %v", input, err)
+		}
+	}
+
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for _, strict := range []bool{false, true} {
+		bd := mimemail.NewBase64Decoder(strings.NewReader(encoded))
+		bd.Strict = strict
+		b, err := ioutil.ReadAll(bd)
+		if err != nil || string(b) != string(data) {
+			t.Errorf("strict %v: round trip failed: %v", strict, err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package mimemail
+
+import (
+	"bytes"
+	"code.google.com/p/mahonia"
+	"fmt"
+	"github.com/sunfmin/mimemail"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+type policyCase struct {
+	policy  mimemail.InvalidBytePolicy
+	charset string
+	input   string
+	output  string
+}
+
+var policyCases = []policyCase{
+	{mimemail.ReplaceInvalid, "utf-8", "J\xf6rg", "J�rg"},
+	{mimemail.ReplaceInvalid, "utf-8", "Jörg\xe6", "Jörg�"},
+	{mimemail.ReplaceInvalid, "x-made-up", "J\xf6rg", "J�rg"},
+	{mimemail.ReplaceInvalid, "iso-8859-1", "J\xf6rg", "Jörg"},
+	{mimemail.FallbackOnInvalid, "utf-8", "Jörg J\xf6rg", "Jörg Jörg"},
+	{mimemail.FallbackOnInvalid, "x-made-up", "J\xf6rg", "Jörg"},
+}
+
+func TestInvalidBytePolicy(t *testing.T) {
+	for _, c := range policyCases {
+		f := &mimemail.PolicyUTF8ReaderFactory{Policy: c.policy}
+		r, err := f.UTF8Reader(c.charset, strings.NewReader(c.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(b) != c.output {
+			t.Errorf("expected: %q, but was: %q", c.output, b)
+		}
+		if !utf8.Valid(b) {
+			t.Errorf("invalid UTF-8: %q", b)
+		}
+	}
+
+	f := &mimemail.PolicyUTF8ReaderFactory{Policy: mimemail.FailOnInvalid}
+	r, _ := f.UTF8Reader("utf-8", strings.NewReader("Jörg J\xf6rg"))
+	b, err := ioutil.ReadAll(r)
+	ie, ok := err.(*mimemail.InvalidByteError)
+	if !ok {
+		t.Fatalf("expected *InvalidByteError, but was %v", err)
+	}
+	if ie.Offset != 7 || string(b) != "Jörg J" {
+		t.Errorf("wrong position: %d, %q", ie.Offset, b)
+	}
+
+	if _, err = f.UTF8Reader("x-made-up", strings.NewReader("")); err == nil {
+		t.Error("expected unsupported charset to fail")
+	}
+
+	// the bytes a RuneDecoder finds invalid, at their offset in the input
+	sjis := "\x93\xfa\x96\x7bab\xff\xfecd" // "日本ab" and two invalid bytes
+	f.Factory = decoderutf8reader{}
+	r, _ = f.UTF8Reader("shift_jis", strings.NewReader(sjis))
+	b, err = ioutil.ReadAll(r)
+	if ie, ok := err.(*mimemail.InvalidByteError); !ok || ie.Offset != 6 || string(ie.Bytes) != "\xff" || string(b) != "日本ab" {
+		t.Errorf("wrong error: %v, %q", err, b)
+	}
+	f.Policy = mimemail.FallbackOnInvalid
+	r, _ = f.UTF8Reader("shift_jis", strings.NewReader(sjis))
+	if b, err = ioutil.ReadAll(r); err != nil || string(b) != "日本abÿþcd" {
+		t.Errorf("wrong fallback: %q, %v", b, err)
+	}
+
+	// a decoder that only gives its output
+	f = &mimemail.PolicyUTF8ReaderFactory{Factory: opaqueutf8reader{}, Policy: mimemail.FailOnInvalid}
+	r, _ = f.UTF8Reader("shift_jis", strings.NewReader(sjis))
+	b, err = ioutil.ReadAll(r)
+	if ie, ok := err.(*mimemail.InvalidByteError); !ok || ie.Offset != -1 || string(b) != "日本ab" {
+		t.Errorf("wrong error: %v, %q", err, b)
+	}
+}
+
+// decoderutf8reader makes DecoderReaders of mahonia's decoders, so that
+// the policy sees the invalid bytes.
+type decoderutf8reader struct{}
+
+func (decoderutf8reader) UTF8Reader(charset string, body io.Reader) (r io.Reader, err error) {
+	dec := mahonia.NewDecoder(charset)
+	if dec == nil {
+		err = fmt.Errorf("charset %s not supported", charset)
+		return
+	}
+	r = mimemail.NewDecoderReader(body, charset, mimemail.RuneDecoderFunc(func(p []byte) (rune, int, mimemail.DecodeStatus) {
+		c, size, status := dec(p)
+		switch status {
+		case mahonia.INVALID_CHAR:
+			return c, size, mimemail.DecodeInvalid
+		case mahonia.NO_ROOM:
+			return c, size, mimemail.DecodeShort
+		case mahonia.STATE_ONLY:
+			return c, size, mimemail.DecodeStateOnly
+		}
+		return c, size, mimemail.DecodeOK
+	}))
+	return
+}
+
+type opaqueutf8reader struct{}
+
+func (opaqueutf8reader) UTF8Reader(charset string, body io.Reader) (io.Reader, error) {
+	return mahonia.NewDecoder(charset).NewReader(body), nil
+}
+
+type utf8writer struct {
+}
+
+func mahoniaEncoder(charset string) mimemail.RuneEncoderFunc {
+	enc := mahonia.NewEncoder(charset)
+	var b [8]byte
+	return func(dst []byte, r rune) ([]byte, bool) {
+		n, status := enc(b[:], r)
+		if status != mahonia.SUCCESS {
+			return dst, false
+		}
+		return append(dst, b[:n]...), true
+	}
+}
+
+func (uw *utf8writer) UTF8Writer(charset string, w io.Writer) (wc io.WriteCloser, err error) {
+	var enc mimemail.RuneEncoder
+	if strings.ToLower(charset) == "iso-2022-jp" {
+		enc = mimemail.NewISO2022JPEncoder(mahoniaEncoder("euc-jp"))
+	} else {
+		enc = mahoniaEncoder(charset)
+	}
+	wc = mimemail.NewEncoderWriter(w, charset, enc)
+	return
+}
+
+var defaultutf8writer = &utf8writer{}
+
+func TestUTF8Writer(t *testing.T) {
+	for _, charset := range []string{"iso-2022-jp", "shift_jis", "euc-jp"} {
+		text := "Fwd: EC未入荷品番が画面上購入可能になっている件"
+		buf := bytes.NewBuffer(nil)
+		wc, err := defaultutf8writer.UTF8Writer(charset, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// write in small pieces to split characters
+		for i := 0; i < len(text); i += 5 {
+			end := i + 5
+			if end > len(text) {
+				end = len(text)
+			}
+			if _, err = io.WriteString(wc, text[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = wc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, _ := defaultutf8reader.UTF8Reader(charset, buf)
+		b, _ := ioutil.ReadAll(r)
+		if string(b) != text {
+			t.Errorf("%s: expected: %s, but was: %s", charset, text, b)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	wc, _ := (&mimemail.DefaultUTF8WriterFactory{}).UTF8Writer("iso-8859-1", buf)
+	io.WriteString(wc, "Jörg € Doe")
+	wc.Close()
+	if buf.String() != "J\xf6rg ? Doe" {
+		t.Errorf("was: %q", buf.String())
+	}
+
+	wc, _ = (&mimemail.DefaultUTF8WriterFactory{Policy: mimemail.FailOnUnencodable}).UTF8Writer("us-ascii", buf)
+	if _, err := io.WriteString(wc, "Jörg"); err == nil {
+		t.Error("expected an error")
+	}
+
+	if !mimemail.CanEncode("iso-8859-15", "Jörg €", nil) {
+		t.Error("expected iso-8859-15 to encode €")
+	}
+	if mimemail.CanEncode("iso-8859-1", "Jörg €", nil) {
+		t.Error("expected iso-8859-1 not to encode €")
+	}
+	if !mimemail.CanEncode("ISO-8859-1", "Jörg", nil) || !mimemail.CanEncode("Latin1", "Jörg", nil) {
+		t.Error("expected charset names in any case and aliases")
+	}
+	if encoded, err := mimemail.EncodeText("Jörg", &mimemail.EncodeOptions{Charset: "ISO-8859-1", Encoding: "Q"}); err != nil || encoded != "=?iso-8859-1?Q?J=F6rg?=" {
+		t.Errorf("was: %q, %v", encoded, err)
+	}
+	if mimemail.CanEncode("iso-2022-jp", "한국어", defaultutf8writer) {
+		t.Error("expected iso-2022-jp not to encode Korean")
+	}
+}
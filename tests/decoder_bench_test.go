@@ -0,0 +1,128 @@
+package mimemail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/sunfmin/mimemail"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+var (
+	benchBinary   []byte
+	benchBase64   []byte
+	benchQP       []byte
+	benchLatin1   []byte
+	benchLineLess []byte
+)
+
+func init() {
+	benchBinary = make([]byte, 256*1024)
+	for i := range benchBinary {
+		benchBinary[i] = byte(i * 7)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	be := mimemail.NewBase64Encoder(buf, false)
+	be.Write(benchBinary)
+	be.Close()
+	benchBase64 = buf.Bytes()
+
+	original, err := ioutil.ReadFile("original.txt")
+	if err != nil {
+		panic(err)
+	}
+	benchLatin1 = original
+	buf = bytes.NewBuffer(nil)
+	qe := mimemail.NewQEncoder(buf, false)
+	qe.Write(original)
+	qe.Close()
+	benchQP = buf.Bytes()
+
+	benchLineLess = []byte(base64.StdEncoding.EncodeToString(benchBinary))
+	for i := 76; i < len(benchLineLess); i += 78 {
+		benchLineLess = append(benchLineLess[:i], append([]byte("\r\n"), benchLineLess[i:]...)...)
+	}
+}
+
+func benchmarkDecoder(b *testing.B, input []byte, newReader func(r io.Reader) io.Reader) {
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.Copy(ioutil.Discard, newReader(bytes.NewReader(input))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkQDecoder(b *testing.B) {
+	benchmarkDecoder(b, benchQP, func(r io.Reader) io.Reader {
+		return mimemail.NewQDecoder(r, false)
+	})
+}
+
+func BenchmarkBase64Decoder(b *testing.B) {
+	benchmarkDecoder(b, benchBase64, func(r io.Reader) io.Reader {
+		return mimemail.NewBase64Decoder(r)
+	})
+}
+
+func BenchmarkLineLessReader(b *testing.B) {
+	benchmarkDecoder(b, benchLineLess, func(r io.Reader) io.Reader {
+		return mimemail.NewLineLessReader(r)
+	})
+}
+
+func BenchmarkISO_8859_1(b *testing.B) {
+	benchmarkDecoder(b, benchLatin1, func(r io.Reader) io.Reader {
+		return mimemail.NewISO_8859_1(r)
+	})
+}
+
+func BenchmarkBodyReaderBase64(b *testing.B) {
+	benchmarkDecoder(b, benchBase64, func(r io.Reader) io.Reader {
+		br, err := mimemail.BodyReader("utf-8", "base64", r, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return br
+	})
+}
+
+func BenchmarkBodyReaderQuotedPrintable(b *testing.B) {
+	benchmarkDecoder(b, benchQP, func(r io.Reader) io.Reader {
+		br, err := mimemail.BodyReader("iso-8859-1", "quoted-printable", r, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return br
+	})
+}
+
+func TestDecoderAllocsPerReader(t *testing.T) {
+	decoders := map[string]func(r io.Reader) io.Reader{
+		"QDecoder":       func(r io.Reader) io.Reader { return mimemail.NewQDecoder(r, false) },
+		"Base64Decoder":  func(r io.Reader) io.Reader { return mimemail.NewBase64Decoder(r) },
+		"LineLessReader": func(r io.Reader) io.Reader { return mimemail.NewLineLessReader(r) },
+		"ISO_8859_1":     func(r io.Reader) io.Reader { return mimemail.NewISO_8859_1(r) },
+	}
+	inputs := map[string][]byte{"QDecoder": benchQP, "Base64Decoder": benchBase64, "LineLessReader": benchLineLess, "ISO_8859_1": benchLatin1}
+	// counting the bytes.Reader, the decoder and its buffers
+	maxAllocs := map[string]float64{"QDecoder": 5, "Base64Decoder": 3, "LineLessReader": 2, "ISO_8859_1": 4}
+	for name, newReader := range decoders {
+		allocs := func(input []byte) float64 {
+			return testing.AllocsPerRun(100, func() {
+				io.Copy(ioutil.Discard, newReader(bytes.NewReader(input)))
+			})
+		}
+		// the allocations are made once per reader, not once per Read
+		input := inputs[name]
+		head := input[:1024+bytes.IndexByte(input[1024:], '\n')+1]
+		if small, large := allocs(head), allocs(input); large != small {
+			t.Errorf("%s: %v allocations for %d bytes, but %v for %d", name, large, len(input), small, len(head))
+		} else if large > maxAllocs[name] {
+			t.Errorf("%s: expected at most %v allocations, but was %v", name, maxAllocs[name], large)
+		}
+	}
+}
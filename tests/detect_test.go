@@ -0,0 +1,116 @@
+package mimemail
+
+import (
+	"code.google.com/p/mahonia"
+	"github.com/sunfmin/mimemail"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+type detectCase struct {
+	charset  string
+	text     string
+	expected string
+}
+
+var detectCases = []detectCase{
+	{"shift_jis", "お世話になっております。来週の打ち合わせの件でご連絡いたしました。", "shift_jis"},
+	{"euc-jp", "お世話になっております。来週の打ち合わせの件でご連絡いたしました。", "euc-jp"},
+	{"gbk", "我们的产品在中国有很多用户，他们说这个是最好的。", "gbk"},
+	{"big5", "我們的產品在中國有很多用戶，他們說這個是最好的。", "big5"},
+	{"windows-1251", "Добрый день, отправляю вам документы по нашему договору.", "windows-1251"},
+	{"koi8-r", "Добрый день, отправляю вам документы по нашему договору.", "koi8-r"},
+	{"iso-8859-1", "Grüße aus München, wir würden uns über eine Antwort freuen.", "iso-8859-1"},
+	{"utf-8", "Grüße aus München", "utf-8"},
+	{"utf-8", "plain ascii", "us-ascii"},
+}
+
+func TestDetectCharset(t *testing.T) {
+	for _, c := range detectCases {
+		b := []byte(c.text)
+		if c.charset != "utf-8" {
+			b = []byte(mahonia.NewEncoder(c.charset).ConvertString(c.text))
+		}
+		charset, _ := mimemail.DetectCharset(b)
+		if charset != c.expected {
+			t.Errorf("%s: expected %s, but was %s", c.charset, c.expected, charset)
+		}
+	}
+
+	// a whole value that ends in an 8-bit byte is not UTF-8 cut short
+	if charset, _ := mimemail.DetectCharset([]byte("Caf\xe9")); charset != "iso-8859-1" {
+		t.Errorf("expected iso-8859-1 for a trailing 8-bit byte, but was %s", charset)
+	}
+	if s, err := mimemail.DecodeTextWithOptions("Caf\xe9", &mimemail.DecodeOptions{DetectCharset: true}); s != "Café" || err != nil {
+		t.Errorf("expected: Café, but was: %q, %v", s, err)
+	}
+
+	charset, _ := mimemail.DetectCharset([]byte(`<html><head><meta http-equiv="Content-Type" content="text/html; charset=Shift_JIS"></head>`))
+	if charset != "shift_jis" {
+		t.Errorf("meta charset was %s", charset)
+	}
+	charset, _ = mimemail.DetectCharset([]byte(`<?xml version="1.0" encoding="EUC-JP"?><a/>`))
+	if charset != "euc-jp" {
+		t.Errorf("xml declaration was %s", charset)
+	}
+}
+
+func TestDetectingUTF8ReaderFactory(t *testing.T) {
+	text := "Grüße aus München"
+	f := &mimemail.DetectingUTF8ReaderFactory{Factory: defaultutf8reader}
+
+	for _, label := range []string{"", "unknown-8bit", "us-ascii"} {
+		body := mahonia.NewEncoder("iso-8859-1").ConvertString(text)
+		r, err := f.UTF8Reader(label, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		if string(b) != text {
+			t.Errorf("label %q: expected %s, but was %s", label, text, b)
+		}
+	}
+
+	// a prefix that cuts a UTF-8 character is still UTF-8
+	short := &mimemail.DetectingUTF8ReaderFactory{Factory: defaultutf8reader, PrefixSize: 16}
+	r, err := short.UTF8Reader("", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != text {
+		t.Errorf("cut prefix: expected %s, but was %s", text, b)
+	}
+
+	// labelled iso-8859-1 but really UTF-8
+	r, err = f.UTF8Reader("iso-8859-1", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != text {
+		t.Errorf("expected %s, but was %s", text, b)
+	}
+}
+
+func TestDetectingUTF8ReaderFactoryUnsupported(t *testing.T) {
+	// DefaultUTF8ReaderFactory has neither windows-1252 nor shift_jis
+	f := &mimemail.DetectingUTF8ReaderFactory{}
+
+	r, err := f.UTF8Reader("us-ascii", strings.NewReader("Caf\xe9 \x93quoted\x94"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "Café \u0093quoted\u0094" {
+		t.Errorf("expected windows-1252 read as iso-8859-1, but was %q", b)
+	}
+
+	sjis := mahonia.NewEncoder("shift_jis").ConvertString(detectCases[0].text)
+	r, err = f.UTF8Reader("", strings.NewReader(sjis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != sjis {
+		t.Errorf("expected the body as it is, but was %q", b)
+	}
+}
@@ -0,0 +1,88 @@
+package mimemail
+
+import (
+	"github.com/sunfmin/mimemail"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+type diagnosticsCollector struct {
+	reports []*mimemail.Diagnostic
+}
+
+func (dc *diagnosticsCollector) Report(d *mimemail.Diagnostic) {
+	dc.reports = append(dc.reports, d)
+}
+
+func (dc *diagnosticsCollector) kinds() (kinds []mimemail.DiagnosticKind) {
+	for _, d := range dc.reports {
+		kinds = append(kinds, d.Kind)
+	}
+	return
+}
+
+func TestDiagnostics(t *testing.T) {
+	dc := &diagnosticsCollector{}
+	opts := &mimemail.DecodeOptions{Diagnostics: dc, Tolerant: true}
+
+	h := textproto.MIMEHeader{"From": {`"=?utf-8?B?5pel5pys6Kqe?=" <a@example.com>`}}
+	if _, err := mimemail.AddressListWithOptions(h, "From", opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(dc.reports) != 1 || dc.reports[0].Kind != mimemail.EncodedWordInQuotedString || dc.reports[0].Text != "=?utf-8?B?5pel5pys6Kqe?=" {
+		t.Errorf("wrong reports: %v", dc.reports)
+	}
+
+	dc.reports = nil
+	mimemail.DecodeTextWithOptions("J\xf6rg =?x-made-up?q?a?= =?utf-8?B?5pel5g?= =?utf-8?q?=ZZ?=", opts)
+	expected := []mimemail.DiagnosticKind{
+		mimemail.EightBitHeader,
+		mimemail.UnsupportedCharset,
+		mimemail.BadBase64,
+		mimemail.InvalidQEscape,
+	}
+	if kinds := dc.kinds(); len(kinds) != len(expected) {
+		t.Errorf("expected: %v, but was: %v", expected, dc.reports)
+	} else {
+		for i := range kinds {
+			if kinds[i] != expected[i] {
+				t.Errorf("expected: %v, but was: %v", expected[i], dc.reports[i])
+			}
+		}
+	}
+	if dc.reports[1].Charset != "x-made-up" || dc.reports[1].Err == nil {
+		t.Errorf("wrong report: %v", dc.reports[1])
+	}
+
+	dc.reports = nil
+	r, err := mimemail.BodyReaderWithOptions("utf-8", "base64", strings.NewReader("5pel5pys6K*qe\r\n"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "日本語" {
+		t.Errorf("was: %q, %v", b, err)
+	}
+	if kinds := dc.kinds(); len(kinds) != 1 || kinds[0] != mimemail.BadBase64 {
+		t.Errorf("wrong reports: %v", dc.reports)
+	}
+
+	// text dropped after a blank line
+	dc.reports = nil
+	r, _ = mimemail.BodyReaderWithOptions("utf-8", "base64", strings.NewReader("5pel5pys6Kqe\r\n\r\n-- \r\nscanned\r\n"), opts)
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "日本語" {
+		t.Errorf("was: %q, %v", b, err)
+	}
+	if len(dc.reports) != 1 || dc.reports[0].Kind != mimemail.BadBase64 || dc.reports[0].Err == nil {
+		t.Errorf("wrong reports: %v", dc.reports)
+	}
+
+	dc.reports = nil
+	if _, err = mimemail.BodyReaderWithOptions("x-made-up", "7bit", strings.NewReader(""), opts); err == nil {
+		t.Error("expected an error")
+	}
+	if kinds := dc.kinds(); len(kinds) != 1 || kinds[0] != mimemail.UnsupportedCharset {
+		t.Errorf("wrong reports: %v", dc.reports)
+	}
+}
@@ -0,0 +1,145 @@
+package mimemail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/sunfmin/mimemail"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func qencode(t *testing.T, text string, setup func(qe *mimemail.QEncoder)) string {
+	buf := bytes.NewBuffer(nil)
+	qe := mimemail.NewQEncoder(buf, false)
+	if setup != nil {
+		setup(qe)
+	}
+	// write in small pieces to split lines and escapes
+	for i := 0; i < len(text); i += 3 {
+		end := i + 3
+		if end > len(text) {
+			end = len(text)
+		}
+		if _, err := io.WriteString(qe, text[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := qe.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+var qencodeCases = []Case{
+	{"a=b", "a=3Db"},
+	{"Jörg", "J=C3=B6rg"},
+	{"trailing \r\nspace\t\nend ", "trailing=20\r\nspace=09\r\nend=20"},
+	{"lone\rcr", "lone=0Dcr"},
+	{strings.Repeat("a", 80), strings.Repeat("a", 75) + "=\r\n" + strings.Repeat("a", 5)},
+	{strings.Repeat("a", 74) + "ö", strings.Repeat("a", 74) + "=\r\n=C3=B6"},
+}
+
+func TestQEncoder(t *testing.T) {
+	for _, c := range qencodeCases {
+		encoded := qencode(t, c.Input, nil)
+		if encoded != c.Output {
+			t.Errorf("expected: %q, but was: %q", c.Output, encoded)
+		}
+	}
+
+	encoded := qencode(t, "From me\r\n.\r\nFoo", func(qe *mimemail.QEncoder) {
+		qe.ProtectDots = true
+		qe.ProtectFrom = true
+	})
+	if encoded != "=46rom me\r\n=2E\r\n=46oo" {
+		t.Errorf("was: %q", encoded)
+	}
+
+	encoded = qencode(t, "a\r\nb", func(qe *mimemail.QEncoder) { qe.Binary = true })
+	if encoded != "a=0D=0Ab" {
+		t.Errorf("was: %q", encoded)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	qe := mimemail.NewQEncoder(buf, true)
+	io.WriteString(qe, "Jörg a=b_c")
+	qe.Close()
+	if buf.String() != "J=C3=B6rg_a=3Db=5Fc" {
+		t.Errorf("was: %q", buf.String())
+	}
+
+	// round trip through QDecoder
+	original, err := ioutil.ReadFile("original.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := strings.Replace(string(original), "\n", "\r\n", -1) + " \t"
+	for _, binary := range []bool{false, true} {
+		encoded = qencode(t, text, func(qe *mimemail.QEncoder) { qe.Binary = binary })
+		for _, line := range strings.Split(encoded, "\r\n") {
+			if len(line) > 76 {
+				t.Fatalf("line too long: %q", line)
+			}
+		}
+		qd := mimemail.NewQDecoder(strings.NewReader(encoded), false)
+		qd.Strict = true
+		decoded, err := ioutil.ReadAll(qd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != text {
+			t.Errorf("binary %v: round trip failed", binary)
+		}
+	}
+}
+
+func TestBase64Encoder(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, size := range []int{9998, 9999, 10000} {
+		buf := bytes.NewBuffer(nil)
+		be := mimemail.NewBase64Encoder(buf, false)
+		for i := 0; i < size; i += 100 {
+			end := i + 100
+			if end > size {
+				end = size
+			}
+			be.Write(data[i:end])
+		}
+		if err := be.Close(); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(buf.String(), "\r\n")
+		for i, line := range lines {
+			if len(line) != 76 && i != len(lines)-1 {
+				t.Fatalf("wrong line length: %q", line)
+			}
+		}
+		expected := base64.StdEncoding.EncodeToString(data[:size])
+		if strings.Join(lines, "") != expected {
+			t.Errorf("%d: wrong encoding", size)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	be := mimemail.NewBase64Encoder(buf, false)
+	be.LineLength = 8
+	be.LineEnding = "\n"
+	io.WriteString(be, "日本語です")
+	be.Close()
+	if buf.String() != "5pel5pys\n6Kqe44Gn\n44GZ" {
+		t.Errorf("was: %q", buf.String())
+	}
+
+	buf.Reset()
+	be = mimemail.NewBase64Encoder(buf, true)
+	io.WriteString(be, strings.Repeat("日本語", 30))
+	be.Close()
+	if buf.String() != base64.StdEncoding.EncodeToString([]byte(strings.Repeat("日本語", 30))) {
+		t.Errorf("was: %q", buf.String())
+	}
+}
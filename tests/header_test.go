@@ -0,0 +1,79 @@
+package mimemail
+
+import (
+	"github.com/sunfmin/mimemail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestDecodeHeader(t *testing.T) {
+	h := textproto.MIMEHeader{
+		"Subject":             {"=?utf-8?B?5pel5pys6Kqe?= =?utf-8?Q?J=C3=B6rg?= test"},
+		"From":                {`"=?iso-8859-1?Q?J=F6rg_Doe?=" <joerg@example.com>`},
+		"Sender":              {"=?utf-8?B?5pel5g==?= =?utf-8?B?nKzoqp4=?= <a@example.com>"},
+		"To":                  {`"=?utf-8?Q?Doe,_John?=" <john@example.com>, jane@example.com`},
+		"Content-Type":        {`application/pdf; name="=?utf-8?B?5pel5pys6Kqe?=.pdf"`},
+		"Content-Disposition": {`attachment; filename*=utf-8''J%C3%B6rg.pdf`},
+		"Message-Id":          {"<=?utf-8?Q?x?=@example.com>"},
+		"X-Custom":            {"=?utf-8?Q?J=C3=B6rg?="},
+	}
+	opts := &mimemail.DecodeOptions{UTF8ReaderFactory: defaultutf8reader}
+
+	mimemail.RegisterFieldDecoder("x-custom", mimemail.DecodeUnstructured)
+	defer mimemail.RegisterFieldDecoder("x-custom", nil)
+	decoded, err := mimemail.DecodeHeader(h, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"Subject":             "日本語Jörg test",
+		"From":                "Jörg Doe <joerg@example.com>",
+		"Sender":              "日本語 <a@example.com>",
+		"To":                  `"Doe, John" <john@example.com>, <jane@example.com>`,
+		"Content-Type":        `application/pdf; name="日本語.pdf"`,
+		"Content-Disposition": `attachment; filename="Jörg.pdf"`,
+		"Message-Id":          "<=?utf-8?Q?x?=@example.com>",
+		"X-Custom":            "Jörg",
+	}
+	for key, v := range expected {
+		if decoded.Get(key) != v {
+			t.Errorf("%s: expected: %q, but was: %q", key, v, decoded.Get(key))
+		}
+	}
+	if h.Get("Subject") == decoded.Get("Subject") {
+		t.Error("expected a copy")
+	}
+
+	h = textproto.MIMEHeader{
+		"Subject": {"=?utf-8?Q?ok?="},
+		"To":      {"not an address"},
+	}
+	decoded, err = mimemail.DecodeHeader(h, opts)
+	if err == nil || !strings.Contains(err.Error(), "To") {
+		t.Errorf("expected an error about To, but was %v", err)
+	}
+	if decoded.Get("To") != "not an address" || decoded.Get("Subject") != "ok" {
+		t.Errorf("wrong fallback: %v", decoded)
+	}
+}
+
+func TestRegisterFieldDecoderConcurrently(t *testing.T) {
+	h := textproto.MIMEHeader{"X-Concurrent": {"=?utf-8?Q?J=C3=B6rg?="}}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			mimemail.RegisterFieldDecoder("X-Concurrent", mimemail.DecodeUnstructured)
+			mimemail.RegisterFieldDecoder("X-Concurrent", nil)
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		mimemail.DecodeHeader(h, nil)
+	}
+	<-done
+
+	if decoded, _ := mimemail.DecodeHeader(h, nil); decoded.Get("X-Concurrent") != h.Get("X-Concurrent") {
+		t.Error("expected the decoder to be removed")
+	}
+}
@@ -0,0 +1,86 @@
+package mimemail
+
+import (
+	"bytes"
+	"github.com/sunfmin/mimemail"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var lineEndingInputs = []string{
+	"a\nb\n",
+	"a\r\nb\r\n",
+	"a\rb\r",
+	"a\r\nb\nc\rd",
+	"\r\r\n\n",
+	"",
+}
+
+var crlfOutputs = []string{
+	"a\r\nb\r\n",
+	"a\r\nb\r\n",
+	"a\r\nb\r\n",
+	"a\r\nb\r\nc\r\nd",
+	"\r\n\r\n\r\n",
+	"",
+}
+
+func TestLineEndings(t *testing.T) {
+	for i, input := range lineEndingInputs {
+		crlf := crlfOutputs[i]
+		lf := strings.Replace(crlf, "\r\n", "\n", -1)
+
+		b, err := ioutil.ReadAll(mimemail.NewCRLFReader(iotest.OneByteReader(strings.NewReader(input))))
+		if err != nil || string(b) != crlf {
+			t.Errorf("CRLF reader: expected: %q, but was: %q, %v", crlf, b, err)
+		}
+		b, err = ioutil.ReadAll(mimemail.NewLFReader(iotest.OneByteReader(strings.NewReader(input))))
+		if err != nil || string(b) != lf {
+			t.Errorf("LF reader: expected: %q, but was: %q, %v", lf, b, err)
+		}
+
+		buf := bytes.NewBuffer(nil)
+		w := mimemail.NewCRLFWriter(buf)
+		for j := 0; j < len(input); j++ {
+			io.WriteString(w, input[j:j+1])
+		}
+		w.Close()
+		if buf.String() != crlf {
+			t.Errorf("CRLF writer: expected: %q, but was: %q", crlf, buf.String())
+		}
+
+		buf.Reset()
+		w = mimemail.NewLFWriter(buf)
+		io.WriteString(w, input)
+		w.Close()
+		if buf.String() != lf {
+			t.Errorf("LF writer: expected: %q, but was: %q", lf, buf.String())
+		}
+	}
+}
+
+func TestCanNormalizeLineEndings(t *testing.T) {
+	cases := []struct {
+		contentType string
+		encoding    string
+		can         bool
+	}{
+		{"", "", true},
+		{"text/plain; charset=utf-8", "8bit", true},
+		{"multipart/mixed; boundary=x", "7bit", false},
+		{"message/rfc822", "", false},
+		{"application/pdf", "base64", true},
+		{"image/png", "Quoted-Printable", true},
+		{"application/octet-stream", "8bit", false},
+		{"text/plain", "binary", false},
+		{"text/plain", "x-made-up", false},
+	}
+	for _, c := range cases {
+		if can := mimemail.CanNormalizeLineEndings(c.contentType, c.encoding); can != c.can {
+			t.Errorf("%q, %q: expected %v", c.contentType, c.encoding, c.can)
+		}
+	}
+}
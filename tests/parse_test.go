@@ -0,0 +1,168 @@
+package mimemail
+
+import (
+	"github.com/sunfmin/mimemail"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+const nestedMessage = `From: =?iso-8859-1?Q?J=F6rg?= <joerg@example.com>
+To: john@example.com
+Subject: =?utf-8?B?5pel5pys6Kqe?=
+Date: Mon, 2 Sep 2013 10:00:00 +0900
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+This is the preamble.
+--outer
+Content-Type: multipart/alternative; boundary=inner
+
+--inner
+Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+J=F6rg says hi=
+.
+--inner
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: base64
+
+PHA+5pel5pys6KqePC9wPg==
+--inner--
+--outer
+Content-Type: application/octet-stream; name="old.bin"
+Content-Disposition: attachment; filename*=utf-8''J%C3%B6rg.bin
+Content-Transfer-Encoding: base64
+
+AAEC/w==
+--outer
+Content-Type: message/rfc822
+
+Subject: =?utf-8?Q?enclosed?=
+
+Enclosed body
+--outer--
+This is the epilogue.
+`
+
+// readAllString reads r, an error is returned as the text so that it
+// shows in the failure.
+func readAllString(r io.Reader, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return string(b)
+}
+
+func TestParse(t *testing.T) {
+	for _, input := range []string{nestedMessage, strings.Replace(nestedMessage, "\n", "\r\n", -1)} {
+		m, err := mimemail.ParseWithOptions(strings.NewReader(input), &mimemail.DecodeOptions{UTF8ReaderFactory: defaultutf8reader})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s, _ := m.Header.Decoded("Subject"); s != "日本語" {
+			t.Errorf("expected the decoded subject, but was: %q", s)
+		}
+		if from, _ := m.Header.AddressList("From"); len(from) != 1 || from[0].Name != "Jörg" {
+			t.Errorf("wrong From: %v", from)
+		}
+		if d, err := m.Header.Date(); err != nil || d.Day() != 2 {
+			t.Errorf("wrong Date: %v, %v", d, err)
+		}
+
+		if m.ContentType != "multipart/mixed" || len(m.Parts) != 3 {
+			t.Fatalf("expected a multipart/mixed with 3 parts, but was %q with %d", m.ContentType, len(m.Parts))
+		}
+		alt := m.Parts[0]
+		if alt.ContentType != "multipart/alternative" || len(alt.Parts) != 2 {
+			t.Fatalf("expected a multipart/alternative with 2 parts, but was %q with %d", alt.ContentType, len(alt.Parts))
+		}
+
+		text := alt.Parts[0]
+		if text.Charset() != "iso-8859-1" || text.TransferEncoding != "quoted-printable" {
+			t.Errorf("wrong text part: %q, %q", text.Charset(), text.TransferEncoding)
+		}
+		if s := readAllString(text.UTF8Reader()); s != "Jörg says hi." {
+			t.Errorf("expected: %q, but was: %q", "Jörg says hi.", s)
+		}
+		if s := readAllString(text.RawReader(), nil); strings.Replace(s, "\r\n", "\n", -1) != "J=F6rg says hi=\n." {
+			t.Errorf("wrong raw body: %q", s)
+		}
+		if s := readAllString(alt.Parts[1].UTF8Reader()); s != "<p>日本語</p>" {
+			t.Errorf("expected: %q, but was: %q", "<p>日本語</p>", s)
+		}
+
+		attachment := m.Parts[1]
+		if attachment.Disposition != "attachment" || attachment.Filename() != "Jörg.bin" {
+			t.Errorf("wrong attachment: %q, %q", attachment.Disposition, attachment.Filename())
+		}
+		if s := readAllString(attachment.DecodedReader()); s != "\x00\x01\x02\xff" {
+			t.Errorf("wrong attachment data: %q", s)
+		}
+
+		enclosed := m.Parts[2]
+		if enclosed.Message == nil {
+			t.Fatal("expected the enclosed message")
+		}
+		if s, _ := enclosed.Message.Header.Decoded("Subject"); s != "enclosed" {
+			t.Errorf("wrong enclosed subject: %q", s)
+		}
+		if enclosed.Message.ContentType != "text/plain" {
+			t.Errorf("expected text/plain by default, but was %q", enclosed.Message.ContentType)
+		}
+		if s := readAllString(enclosed.Message.RawReader(), nil); s != "Enclosed body" {
+			t.Errorf("wrong enclosed body: %q", s)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	// no close delimiter and a bare Content-Type with a stray ";"
+	m, err := mimemail.Parse(strings.NewReader("Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain;\r\n\r\nfirst\r\n--b\r\n\r\nlast\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Parts) != 2 {
+		t.Fatalf("expected 2 parts, but was %d", len(m.Parts))
+	}
+	if m.Parts[0].ContentType != "text/plain" || m.Parts[1].ContentType != "text/plain" {
+		t.Errorf("wrong content types: %q, %q", m.Parts[0].ContentType, m.Parts[1].ContentType)
+	}
+	if s := readAllString(m.Parts[1].UTF8Reader()); s != "last\r\n" {
+		t.Errorf("expected: %q, but was: %q", "last\r\n", s)
+	}
+
+	m, err = mimemail.Parse(strings.NewReader("Content-Type: multipart/digest; boundary=b\r\n\r\n--b\r\n\r\nSubject: digested\r\n\r\nbody\r\n--b--\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Parts) != 1 || m.Parts[0].Message == nil || m.Parts[0].Message.Header.Get("Subject") != "digested" {
+		t.Error("expected the parts of a digest to be messages")
+	}
+
+	if _, err = mimemail.Parse(strings.NewReader("Content-Type: multipart/mixed; boundary=b\r\n\r\nno parts\r\n")); err == nil {
+		t.Error("expected an error for a missing boundary")
+	}
+
+	// lines longer than the buffer, and a boundary followed by whitespace
+	long := strings.Repeat("x", 10000)
+	m, err = mimemail.Parse(iotest.OneByteReader(strings.NewReader("Content-Type: multipart/mixed; boundary=b\n\n--b \n\n" + long + "\n" + long + "\n--b-- \t\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Parts) != 1 || readAllString(m.Parts[0].RawReader(), nil) != long+"\n"+long {
+		t.Error("wrong body with long lines")
+	}
+
+	nested := strings.Repeat("Content-Type: message/rfc822\r\n\r\n", 200)
+	if _, err = mimemail.Parse(strings.NewReader(nested)); err == nil {
+		t.Error("expected an error for too deep nesting")
+	}
+}
@@ -0,0 +1,38 @@
+package mimemail
+
+import (
+	"github.com/sunfmin/mimemail"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var (
+	benchSubject   = "Re: =?utf-8?B?SGVsbG8gUERGIOWKoOeCueS4reaWh+WSjOaXpeacrOiqnuOBig==?=\r\n =?utf-8?B?44Gv44KI44GG44GU44GW44GE44G+44GZ?= and some raw text"
+	benchRaw       = strings.Repeat("A long header line of raw text without any encoded-words at all. ", 64)
+	benchManyWords = strings.Repeat("=?iso-8859-1?q?J=F6rg_Doe?= ", 256)
+)
+
+func benchmarkRFC2047Reader(b *testing.B, input string) {
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := mimemail.NewRFC2047Reader(strings.NewReader(input), nil)
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRFC2047ReaderSubject(b *testing.B) {
+	benchmarkRFC2047Reader(b, benchSubject)
+}
+
+func BenchmarkRFC2047ReaderRaw(b *testing.B) {
+	benchmarkRFC2047Reader(b, benchRaw)
+}
+
+func BenchmarkRFC2047ReaderManyWords(b *testing.B) {
+	benchmarkRFC2047Reader(b, benchManyWords)
+}
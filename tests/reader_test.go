@@ -12,6 +12,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 type utf8reader struct {
@@ -98,6 +99,31 @@ func TestLinelessReader(t *testing.T) {
 	}
 }
 
+func TestByteFilterReader(t *testing.T) {
+	r := mimemail.NewLineLessReader(iotest.HalfReader(strings.NewReader("a\x00a\r\nb\tb\n")))
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "a\x00ab\tb" {
+		t.Errorf("was: %q, %v", b, err)
+	}
+
+	r2 := mimemail.NewByteFilterReader(iotest.OneByteReader(strings.NewReader("ab cd\r\nef\t\r\n")), mimemail.WhitespaceBytes)
+	if b, err = ioutil.ReadAll(r2); err != nil || string(b) != "abcdef" {
+		t.Errorf("was: %q, %v", b, err)
+	}
+
+	r2 = mimemail.NewByteFilterReader(strings.NewReader("a\r\nb\r\n"), mimemail.CRBytes)
+	if b, err = ioutil.ReadAll(r2); err != nil || string(b) != "a\nb\n" {
+		t.Errorf("was: %q, %v", b, err)
+	}
+
+	// the bytes after n in p must not be used
+	p := []byte("xxxxxxxx")
+	n, _ := mimemail.NewByteFilterReader(strings.NewReader("ab\n"), mimemail.LineBreakBytes).Read(p)
+	if string(p[:n]) != "ab" {
+		t.Errorf("was: %q", p[:n])
+	}
+}
+
 func TestQuotedPrintable(t *testing.T) {
 	f, err := os.Open("quoted-printable.txt")
 	defer f.Close()
@@ -133,6 +159,51 @@ func TestQuotedPrintable(t *testing.T) {
 	}
 }
 
+var lenientQCases = []Case{
+	{"a=3Db=3db", "a=b=b"},
+	{"http://example.com/?a=b&c=1", "http://example.com/?a=b&c=1"},
+	{"soft =\t\r\nbreak", "soft break"},
+	{"soft=\nbreak", "softbreak"},
+	{"trailing  \t\r\nspace \n", "trailing\r\nspace\n"},
+	{"end=", "end"},
+	{"=4", "=4"},
+	{"=C3=B6", "ö"},
+	{strings.Repeat("a", 5000) + "=3D" + strings.Repeat(" ", 5000) + "=\nb", strings.Repeat("a", 5000) + "=" + strings.Repeat(" ", 5000) + "b"},
+	{strings.Repeat("a", 4095) + "=3D" + strings.Repeat("b", 5000) + " \t \n", strings.Repeat("a", 4095) + "=" + strings.Repeat("b", 5000) + "\n"},
+}
+
+var strictQErrors = []string{
+	"a=3db",
+	"?a=b&c=1",
+	"end=",
+	"=4",
+}
+
+func TestQDecoderModes(t *testing.T) {
+	for _, c := range lenientQCases {
+		b, err := ioutil.ReadAll(iotest.OneByteReader(mimemail.NewQDecoder(strings.NewReader(c.Input), false)))
+		if err != nil {
+			t.Error(err)
+		}
+		if string(b) != c.Output {
+			t.Errorf("expected: %q, but was: %q", c.Output, b)
+		}
+	}
+	for _, input := range strictQErrors {
+		qd := mimemail.NewQDecoder(strings.NewReader(input), false)
+		qd.Strict = true
+		if b, err := ioutil.ReadAll(qd); err == nil {
+			t.Errorf("%q: expected an error, but was: %q", input, b)
+		}
+	}
+
+	qd := mimemail.NewQDecoder(strings.NewReader("a=3D =\r\nb"), false)
+	qd.Strict = true
+	if b, err := ioutil.ReadAll(qd); err != nil || string(b) != "a= b" {
+		t.Errorf("was: %q, %v", b, err)
+	}
+}
+
 type addressCase struct {
 	filename          string
 	key               string
@@ -194,3 +265,284 @@ func TestAddressList(t *testing.T) {
 
 	}
 }
+
+var encodedNameCases = []Case{
+	// a character split across encoded-words
+	{"=?utf-8?B?5pel5g==?= =?utf-8?B?nKzoqp4=?= <a@example.com>", "日本語"},
+	{"=?utf-8?q?=E6=97?= =?utf-8?q?=A5?= <a@example.com>", "日"},
+	{"=?utf-8?q?a?= =?utf-8?q?b?= <a@example.com>", "ab"},
+	{"=?utf-8?q?J=C3=B6rg?= Doe <a@example.com>", "Jörg Doe"},
+	{"Re =?utf-8?q?a?=  =?utf-8?q?b?= c <a@example.com>", "Re ab c"},
+}
+
+func TestAddressListEncodedWords(t *testing.T) {
+	for _, c := range encodedNameCases {
+		addresses, err := mimemail.AddressList(textproto.MIMEHeader{"From": {c.Input}}, "From", defaultutf8reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addresses) != 1 || addresses[0].Name != c.Output {
+			t.Errorf("%q: expected: %q, but was: %v", c.Input, c.Output, addresses)
+		}
+	}
+}
+
+func TestRaw8bitHeaders(t *testing.T) {
+	sjis := mahonia.NewEncoder("shift_jis").ConvertString("お世話になっております")
+	gbk := mahonia.NewEncoder("gbk").ConvertString("我们的产品")
+
+	optsCases := []struct {
+		opts   *mimemail.DecodeOptions
+		input  string
+		output string
+	}{
+		{&mimemail.DecodeOptions{UTF8ReaderFactory: defaultutf8reader, FallbackCharset: "shift_jis"}, "Re: " + sjis, "Re: お世話になっております"},
+		{&mimemail.DecodeOptions{UTF8ReaderFactory: defaultutf8reader, DetectCharset: true}, "Re: " + gbk + " =?utf-8?B?5pel5pys6Kqe?=", "Re: 我们的产品 日本語"},
+		{&mimemail.DecodeOptions{UTF8ReaderFactory: defaultutf8reader, FallbackCharset: "shift_jis"}, "Re: 日本語", "Re: 日本語"},
+	}
+	for _, c := range optsCases {
+		decoded, err := mimemail.DecodeTextWithOptions(c.input, c.opts)
+		if err != nil {
+			t.Error(err)
+		}
+		if decoded != c.output {
+			t.Errorf("expected: %s, but was: %s", c.output, decoded)
+		}
+	}
+
+	h := textproto.MIMEHeader{"From": {gbk + " <chen@example.com>, \"" + gbk + "\" <li@example.com>"}}
+	addresses, err := mimemail.AddressListWithOptions(h, "From", &mimemail.DecodeOptions{UTF8ReaderFactory: defaultutf8reader, FallbackCharset: "gbk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 2 || addresses[0].Name != "我们的产品" || addresses[1].Name != "我们的产品" {
+		t.Errorf("wrong addresses: %v", addresses)
+	}
+
+	// raw UTF-8 in atoms and quoted-strings, RFC 6532, only with 8-bit decoding
+	h = textproto.MIMEHeader{"From": {"Jörg <joerg@example.com>, \"日本 語\" <a@example.com>"}}
+	if _, err = mimemail.AddressList(h, "From", defaultutf8reader); err == nil {
+		t.Error("expected an error for raw UTF-8 without a fallback charset")
+	}
+	for _, opts := range []*mimemail.DecodeOptions{{FallbackCharset: "gbk"}, {DetectCharset: true}} {
+		opts.UTF8ReaderFactory = defaultutf8reader
+		addresses, err = mimemail.AddressListWithOptions(h, "From", opts)
+		if err != nil || len(addresses) != 2 || addresses[0].Name != "Jörg" || addresses[1].Name != "日本 語" {
+			t.Errorf("wrong addresses with %+v: %v, %v", opts, addresses, err)
+		}
+	}
+}
+
+func TestTolerantDecoding(t *testing.T) {
+	input := "Re: =?x-made-up?B?5pel5pys6Kqe?= and =?utf-8?B?5pel5pys6Kqe?="
+
+	if _, err := mimemail.DecodeText(input, nil); err == nil {
+		t.Error("expected an error without tolerant mode")
+	}
+
+	decoded, warnings := mimemail.DecodeTextTolerant(input, nil)
+	if decoded != "Re: =?x-made-up?B?5pel5pys6Kqe?= and 日本語" {
+		t.Errorf("was: %s", decoded)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected one warning, but was: %v", warnings)
+	}
+	if we, ok := warnings[0].(*mimemail.EncodedWordError); !ok || we.Word != "=?x-made-up?B?5pel5pys6Kqe?=" {
+		t.Errorf("wrong warning: %v", warnings[0])
+	}
+
+	decoded, _ = mimemail.DecodeTextTolerant(input, &mimemail.DecodeOptions{FallbackCharset: "utf-8"})
+	if decoded != "Re: 日本語 and 日本語" {
+		t.Errorf("was: %s", decoded)
+	}
+}
+
+var whitespaceCases = []Case{
+	{"Hello =?utf-8?q?W?= world", "Hello W world"},
+	{"=?utf-8?q?a?=  \r\n =?utf-8?q?b?=", "ab"},
+	{"=?utf-8?q?a?= b =?utf-8?q?c?=", "a b c"},
+	{"a   b\t\tc  ", "a   b\t\tc  "},
+	{"   ", "   "},
+	{"=?utf-8?q?a?=   ", "a   "},
+	{"Re:=?utf-8?q?a?=", "Re:=?utf-8?q?a?="},
+	{"(=?utf-8?q?a?=)", "(=?utf-8?q?a?=)"},
+	{"=?utf-8?q?a?==?utf-8?q?b?=", "=?utf-8?q?a?==?utf-8?q?b?="},
+}
+
+var lenientCases = []Case{
+	{"Re:=?utf-8?q?a?=", "Re:a"},
+	{"(=?utf-8?q?a?=)", "(a)"},
+	{"=?utf-8?q?a?==?utf-8?q?b?=", "ab"},
+}
+
+func TestWhitespace(t *testing.T) {
+	for _, c := range whitespaceCases {
+		decoded, err := mimemail.DecodeText(c.Input, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		if decoded != c.Output {
+			t.Errorf("expected: %q, but was: %q", c.Output, decoded)
+		}
+	}
+	for _, c := range lenientCases {
+		decoded, err := mimemail.DecodeTextWithOptions(c.Input, &mimemail.DecodeOptions{Lenient: true})
+		if err != nil {
+			t.Error(err)
+		}
+		if decoded != c.Output {
+			t.Errorf("lenient expected: %q, but was: %q", c.Output, decoded)
+		}
+	}
+}
+
+var joinCases = []Case{
+	{"=?utf-8?B?5pel5g==?= =?utf-8?B?nKzoqp4=?=", "日本語"},
+	{"=?ISO-2022-JP?B?GyRCRnw=?=\r\n =?iso-2022-jp?B?S1w4bCRHJDkbKEI=?=", "日本語です"},
+	{"=?utf-8?B?5pel5g==?= =?iso-8859-1?q?J=F6rg?=", "日�Jörg"},
+}
+
+func TestJoinEncodedWords(t *testing.T) {
+	for _, c := range joinCases {
+		decoded, err := mimemail.DecodeText(c.Input, defaultutf8reader)
+		if err != nil {
+			t.Error(err)
+		}
+		if decoded != c.Output {
+			t.Errorf("expected: %q, but was: %q", c.Output, decoded)
+		}
+	}
+}
+
+var notWordCases = []Case{
+	{"see http://example.com/?a=?b and =?utf-8?q?x?=", "see http://example.com/?a=?b and x"},
+	{"x =? y", "x =? y"},
+	{"a =?utf-8?x?abc?= b", "a =?utf-8?x?abc?= b"},
+	{"a =?utf 8?q?abc?= b", "a =?utf 8?q?abc?= b"},
+	{"a =?utf-8?q?a b?= c", "a =?utf-8?q?a b?= c"},
+	{"a =?utf-8?q??= b", "a =?utf-8?q??= b"},
+	{"=?utf-8?q?" + strings.Repeat("a", 200) + "?=", "=?utf-8?q?" + strings.Repeat("a", 200) + "?="},
+	{"=?", "=?"},
+	{"=?utf-8?q?abc", "=?utf-8?q?abc"},
+}
+
+func TestNotEncodedWords(t *testing.T) {
+	for _, c := range notWordCases {
+		decoded, err := mimemail.DecodeText(c.Input, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		if decoded != c.Output {
+			t.Errorf("expected: %q, but was: %q", c.Output, decoded)
+		}
+	}
+}
+
+func TestLookaheadBoundaries(t *testing.T) {
+	word := "=?utf-8?B?5pel5pys6Kqe?="
+	opts := &mimemail.DecodeOptions{Lookahead: 1}
+	for i := 0; i < 300; i++ {
+		prefix := strings.Repeat("x", i)
+		inputs := []Case{
+			{prefix + " " + word + " tail", prefix + " 日本語 tail"},
+			{prefix + " " + word + "\r\n " + word, prefix + " 日本語日本語"},
+			{prefix + " " + strings.Repeat(" ", i) + word, prefix + " " + strings.Repeat(" ", i) + "日本語"},
+			{word + strings.Repeat(" ", i+1) + word, "日本語日本語"},
+			{word + strings.Repeat(" ", i+1) + "x", "日本語" + strings.Repeat(" ", i+1) + "x"},
+			{prefix + " =?utf-8?q?" + strings.Repeat("a", 150) + "?=", prefix + " " + strings.Repeat("a", 150)},
+		}
+		for _, c := range inputs {
+			r := mimemail.NewRFC2047ReaderWithOptions(iotest.OneByteReader(strings.NewReader(c.Input)), opts)
+			b, err := ioutil.ReadAll(iotest.OneByteReader(r))
+			if err != nil {
+				t.Error(err)
+			}
+			if string(b) != c.Output {
+				t.Errorf("expected: %q, but was: %q", c.Output, b)
+			}
+		}
+	}
+}
+
+func TestLanguageTags(t *testing.T) {
+	r := mimemail.NewRFC2047Reader(strings.NewReader("=?US-ASCII*EN?Q?Keith_Moore?= and =?utf-8*ja?B?5pel5pys6Kqe?="), nil)
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "Keith Moore and 日本語" {
+		t.Errorf("was: %s", b)
+	}
+	if len(r.Words) != 2 {
+		t.Fatalf("expected two words, but was: %v", r.Words)
+	}
+	if r.Words[0].Charset != "US-ASCII" || r.Words[0].Language != "EN" || r.Words[1].Language != "ja" {
+		t.Errorf("wrong words: %+v, %+v", r.Words[0], r.Words[1])
+	}
+}
+
+func TestDecodeTextSegments(t *testing.T) {
+	var cases []Case
+	cases = append(cases, whitespaceCases...)
+	cases = append(cases, joinCases...)
+	cases = append(cases, notWordCases...)
+	for _, c := range cases {
+		segments, err := mimemail.DecodeTextSegments(c.Input, &mimemail.DecodeOptions{UTF8ReaderFactory: defaultutf8reader})
+		if err != nil {
+			t.Error(err)
+		}
+		var raw, text string
+		for _, s := range segments {
+			raw += s.Raw
+			text += s.Text
+		}
+		if raw != c.Input || text != c.Output {
+			t.Errorf("expected: %q, %q, but was: %q, %q", c.Input, c.Output, raw, text)
+		}
+	}
+
+	input := "Re: =?utf-8*ja?B?5pel5g==?= =?utf-8*ja?B?nKzoqp4=?= =?x-made-up?q?a?= end"
+	segments, _ := mimemail.DecodeTextSegments(input, &mimemail.DecodeOptions{Tolerant: true})
+	expected := []mimemail.Segment{
+		{Raw: "Re: ", Text: "Re: "},
+		{Raw: "=?utf-8*ja?B?5pel5g==?= =?utf-8*ja?B?nKzoqp4=?=", Encoded: true, Charset: "utf-8", Encoding: "B", Language: "ja", Text: "日本語"},
+		{Raw: " "},
+		{Raw: "=?x-made-up?q?a?=", Encoded: true, Charset: "x-made-up", Encoding: "q", Text: "=?x-made-up?q?a?="},
+		{Raw: " end", Text: " end"},
+	}
+	if len(segments) != len(expected) {
+		t.Fatalf("expected %d segments, but was: %+v", len(expected), segments)
+	}
+	for i, s := range segments {
+		if i == 3 {
+			if s.Err == nil {
+				t.Error("expected an error for the unsupported charset")
+			}
+			s.Err = nil
+		}
+		if s != expected[i] {
+			t.Errorf("expected: %+v, but was: %+v", expected[i], s)
+		}
+	}
+
+	segments, err := mimemail.DecodeTextSegments(input, nil)
+	if err == nil || len(segments) != 4 || segments[3].Err == nil || segments[3].Text != "" {
+		t.Errorf("expected decoding to stop at the unsupported charset: %+v, %v", segments, err)
+	}
+
+	// a change of language starts a new segment
+	segments, _ = mimemail.DecodeTextSegments("=?utf-8*en?q?a?= =?utf-8*ja?q?b?=", nil)
+	expected = []mimemail.Segment{
+		{Raw: "=?utf-8*en?q?a?=", Encoded: true, Charset: "utf-8", Encoding: "q", Language: "en", Text: "a"},
+		{Raw: " "},
+		{Raw: "=?utf-8*ja?q?b?=", Encoded: true, Charset: "utf-8", Encoding: "q", Language: "ja", Text: "b"},
+	}
+	if len(segments) != len(expected) {
+		t.Fatalf("expected %d segments, but was: %+v", len(expected), segments)
+	}
+	for i, s := range segments {
+		if s != expected[i] {
+			t.Errorf("expected: %+v, but was: %+v", expected[i], s)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package mimemail
+
+import (
+	"bytes"
+	"github.com/sunfmin/mimemail"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var transferEncodingNames = []Case{
+	{"", "7bit"},
+	{"7BIT", "7bit"},
+	{"7-bit", "7bit"},
+	{"Base64 ", "base64"},
+	{"base-64", "base64"},
+	{"\"base64\"", "base64"},
+	{"base64; charset=utf-8", "base64"},
+	{"Quoted_Printable", "quoted-printable"},
+	{"quoted printable", "quoted-printable"},
+	{"X-UUEncode", "x-uuencode"},
+	{"B", "base64"},
+	{"q", "quoted-printable"},
+	{"x-made-up", "x-made-up"},
+}
+
+func TestNormalizeTransferEncoding(t *testing.T) {
+	for _, c := range transferEncodingNames {
+		if n := mimemail.NormalizeTransferEncoding(c.Input); n != c.Output {
+			t.Errorf("%q: expected: %q, but was: %q", c.Input, c.Output, n)
+		}
+	}
+}
+
+func TestTransferDecoderRegistry(t *testing.T) {
+	for _, encoding := range []string{"Base64 ", "base-64", "BASE64"} {
+		r, err := mimemail.BodyReader("utf-8", encoding, strings.NewReader("5pel5pys6Kqe"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(r); string(b) != "日本語" {
+			t.Errorf("%q: was: %q", encoding, b)
+		}
+	}
+
+	// "b" and "q" were accepted for bodies before the registry
+	for _, c := range []Case{{"b", "5pel5pys6Kqe"}, {"B", "5pel5pys6Kqe"}, {"q", "=E6=97=A5=E6=9C=AC=E8=AA=9E"}, {"Q", "=E6=97=A5=E6=9C=AC=E8=AA=9E"}} {
+		r, err := mimemail.BodyReader("utf-8", c.Input, strings.NewReader(c.Output), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(r); string(b) != "日本語" {
+			t.Errorf("%q: was: %q", c.Input, b)
+		}
+	}
+	m, err := mimemail.Parse(strings.NewReader("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: b\r\n\r\n5pel5pys6Kqe\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := readAllString(m.UTF8Reader()); s != "日本語" {
+		t.Errorf("Content-Transfer-Encoding b: was: %q", s)
+	}
+
+	_, err = mimemail.BodyReader("utf-8", "x-made-up", strings.NewReader("abc"), nil)
+	if ue, ok := err.(*mimemail.UnknownTransferEncodingError); !ok || ue.Encoding != "x-made-up" {
+		t.Errorf("expected *UnknownTransferEncodingError, but was: %v", err)
+	}
+
+	dc := &diagnosticsCollector{}
+	r, err := mimemail.BodyReaderWithOptions("utf-8", "x-made-up", strings.NewReader("abc"), &mimemail.DecodeOptions{Tolerant: true, Diagnostics: dc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "abc" {
+		t.Errorf("was: %q", b)
+	}
+	if kinds := dc.kinds(); len(kinds) != 1 || kinds[0] != mimemail.UnknownTransferEncoding {
+		t.Errorf("wrong reports: %v", dc.reports)
+	}
+
+	mimemail.RegisterTransferDecoder("X-Reversed", func(r io.Reader, diag mimemail.Diagnostics) io.Reader {
+		b, _ := ioutil.ReadAll(r)
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return bytes.NewReader(b)
+	})
+	defer mimemail.RegisterTransferDecoder("X-Reversed", nil)
+	r, err = mimemail.BodyReader("utf-8", "x-reversed", strings.NewReader("cba"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "abc" {
+		t.Errorf("was: %q", b)
+	}
+}
+
+func TestRegisterTransferDecoderConcurrently(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			mimemail.RegisterTransferDecoder("x-concurrent", func(r io.Reader, diag mimemail.Diagnostics) io.Reader {
+				return r
+			})
+			mimemail.RegisterTransferDecoder("x-concurrent", nil)
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		mimemail.BodyReader("utf-8", "x-concurrent", strings.NewReader("abc"), nil)
+	}
+	<-done
+
+	if _, err := mimemail.BodyReader("utf-8", "x-concurrent", strings.NewReader("abc"), nil); err == nil {
+		t.Error("expected the decoder to be removed")
+	}
+}
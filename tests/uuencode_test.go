@@ -0,0 +1,88 @@
+package mimemail
+
+import (
+	"github.com/sunfmin/mimemail"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const uuencoded = "begin 644 data.bin\nM``<.%1PC*C$X/T9-5%MB:7!W?H6,DYJAJ*^VO<3+TMG@Y^[U_`,*$1@?)BTT\nM.T))4%=>96QS>H&(CY:=I*NRN<#'SM7<X^KQ^/\\&#10;(BDP-SY%3%-:86AO\n*=GV$BY*9H*>NM0``\n`\nend\n"
+
+func uudata() []byte {
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestUUDecoder(t *testing.T) {
+	r, err := mimemail.BodyReader("", "x-uuencode", strings.NewReader("some text\r\n"+strings.Replace(uuencoded, "\n", "\r\n", -1)+"more text\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(uudata()) {
+		t.Errorf("was: %q", b)
+	}
+
+	ud := mimemail.NewUUDecoder(strings.NewReader(uuencoded))
+	ioutil.ReadAll(ud)
+	if ud.Name != "data.bin" || ud.Mode != 0644 {
+		t.Errorf("wrong name or mode: %s, %v", ud.Name, ud.Mode)
+	}
+
+	// trailing spaces stripped by the transport
+	b, err = ioutil.ReadAll(mimemail.NewUUDecoder(strings.NewReader("begin 600 a\n#86)C\n!80  \n`\nend\n")))
+	if err != nil || string(b) != "abca" {
+		t.Errorf("was: %q, %v", b, err)
+	}
+
+	if _, err = ioutil.ReadAll(mimemail.NewUUDecoder(strings.NewReader("no data\n"))); err != mimemail.ErrNoUUBegin {
+		t.Errorf("expected ErrNoUUBegin, but was: %v", err)
+	}
+
+	// text lines longer than the buffer before the "begin" line
+	long := strings.Repeat("x", 10000)
+	b, err = ioutil.ReadAll(mimemail.NewUUDecoder(strings.NewReader(long + "\n" + uuencoded)))
+	if err != nil || string(b) != string(uudata()) {
+		t.Errorf("was: %q, %v", b, err)
+	}
+	if _, err = ioutil.ReadAll(mimemail.NewUUDecoder(strings.NewReader(long))); err != mimemail.ErrNoUUBegin {
+		t.Errorf("expected ErrNoUUBegin, but was: %v", err)
+	}
+}
+
+func TestExtractUUEncoded(t *testing.T) {
+	input := "Hello,\n\n" + uuencoded + "Regards\nbegin 644 not a block\nbegin 644 x.txt\nHello world\nend\n"
+	text, files, err := mimemail.ExtractUUEncoded(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(text) != "Hello,\n\nRegards\nbegin 644 not a block\nbegin 644 x.txt\nHello world\nend\n" {
+		t.Errorf("was: %q", text)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected one file, but was: %v", files)
+	}
+	if files[0].Name != "data.bin" || files[0].Mode != 0644 || string(files[0].Data) != string(uudata()) {
+		t.Errorf("wrong file: %+v", files[0])
+	}
+}
+
+func TestExtractUUEncodedAfterFalseBegin(t *testing.T) {
+	text, files, err := mimemail.ExtractUUEncoded(strings.NewReader("begin 644 x\n" + uuencoded + "Regards\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(text) != "begin 644 x\nRegards\n" {
+		t.Errorf("was: %q", text)
+	}
+	if len(files) != 1 || files[0].Name != "data.bin" || string(files[0].Data) != string(uudata()) {
+		t.Errorf("expected data.bin after the false begin, but was: %v", files)
+	}
+}
@@ -0,0 +1,127 @@
+package mimemail
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sunfmin/mimemail"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	var visited []string
+	err := mimemail.WalkWithOptions(strings.NewReader(nestedMessage), &mimemail.DecodeOptions{UTF8ReaderFactory: defaultutf8reader}, func(ph *mimemail.PartHeader, body io.Reader) error {
+		v := fmt.Sprintf("%d %s", ph.Depth, ph.ContentType)
+		switch {
+		case body == nil:
+		case ph.Charset() != "":
+			v += " " + readAllString(ph.UTF8Reader(body))
+		default:
+			v += fmt.Sprintf(" %q", readAllString(ph.DecodedReader(body)))
+		}
+		visited = append(visited, v)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"0 multipart/mixed",
+		"1 multipart/alternative",
+		"2 text/plain Jörg says hi.",
+		"2 text/html <p>日本語</p>",
+		`1 application/octet-stream "\x00\x01\x02\xff"`,
+		"1 message/rfc822",
+		`2 text/plain "Enclosed body"`,
+	}
+	if strings.Join(visited, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\nbut was:\n%s", strings.Join(expected, "\n"), strings.Join(visited, "\n"))
+	}
+
+	// skipping the alternative and the bodies that are not read
+	visited = nil
+	err = mimemail.Walk(strings.NewReader(nestedMessage), func(ph *mimemail.PartHeader, body io.Reader) error {
+		visited = append(visited, ph.ContentType)
+		if ph.ContentType == "multipart/alternative" {
+			return mimemail.SkipPart
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Join(visited, ","); s != "multipart/mixed,multipart/alternative,application/octet-stream,message/rfc822,text/plain" {
+		t.Errorf("wrong parts visited: %s", s)
+	}
+
+	stop := errors.New("stop")
+	visited = nil
+	err = mimemail.Walk(strings.NewReader(nestedMessage), func(ph *mimemail.PartHeader, body io.Reader) error {
+		visited = append(visited, ph.ContentType)
+		if ph.Depth == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || len(visited) != 3 {
+		t.Errorf("expected to stop at the first part of depth 2, but was %v after %v", err, visited)
+	}
+}
+
+// hugeMessage generates a message with an attachment of size bytes.
+func hugeMessage(size int) io.Reader {
+	line := strings.Repeat("QUJD", 19) + "\r\n" // 57 bytes of "ABC"
+	return io.MultiReader(
+		strings.NewReader("Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nsee the attachment\r\n"+
+			"--b\r\nContent-Type: application/octet-stream\r\nContent-Transfer-Encoding: base64\r\n\r\n"),
+		io.LimitReader(&repeatReader{s: line}, int64(size/57*len(line))),
+		strings.NewReader("\r\n--b--\r\n"),
+	)
+}
+
+type repeatReader struct {
+	s   string
+	pos int
+}
+
+func (rr *repeatReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		m := copy(p[n:], rr.s[rr.pos:])
+		rr.pos = (rr.pos + m) % len(rr.s)
+		n += m
+	}
+	return
+}
+
+func TestWalkBoundedMemory(t *testing.T) {
+	const size = 32 << 20
+	for _, read := range []bool{false, true} {
+		var decoded int64
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err := mimemail.Walk(hugeMessage(size), func(ph *mimemail.PartHeader, body io.Reader) (err error) {
+			if !read || ph.ContentType != "application/octet-stream" {
+				return
+			}
+			var r io.Reader
+			if r, err = ph.DecodedReader(body); err != nil {
+				return
+			}
+			decoded, err = io.Copy(ioutil.Discard, r)
+			return
+		})
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read && decoded != size/57*57 {
+			t.Errorf("expected %d bytes, but was %d", size/57*57, decoded)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("expected bounded memory, but %d bytes were allocated", allocated)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package mimemail
+
+import (
+	"github.com/sunfmin/mimemail"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var encodeTexts = []string{
+	"Hello World",
+	"Jörg Doe",
+	"Fwd: EC未入荷品番が画面上購入可能になっている件",
+	"Hello PDF 加点中文和日本語おはようございます and some more plain ASCII words to make it long enough to fold",
+	"  leading and trailing spaces  ",
+	"a =?utf-8?q?not_a_word?= b",
+	strings.Repeat("日本語 ", 30) + "end",
+	"Grüße aus München, wir würden uns über eine Antwort freuen, schöne Grüße",
+	"Jörg\r\nBcc: evil@example.com",
+	"a\nb",
+	"a\r\n b\r",
+	"Re: a few ASCII words first, then" + strings.Repeat(" ", 6) + strings.Repeat("日本語", 20),
+	strings.Repeat("x", 40) + "\t\t\t\t" + strings.Repeat("ü", 40),
+}
+
+var encodedWordRegexp = regexp.MustCompile(`=\?[^?]+\?[BQ]\?[^?]*\?=`)
+
+func TestEncodeText(t *testing.T) {
+	optsList := []*mimemail.EncodeOptions{
+		{Column: len("Subject: ")},
+		{Encoding: "B"},
+		{Encoding: "Q"},
+		{Charset: "iso-2022-jp", UTF8WriterFactory: defaultutf8writer},
+	}
+	for _, opts := range optsList {
+		for _, text := range encodeTexts {
+			if opts.Charset == "iso-2022-jp" && strings.ContainsAny(text, "öü") {
+				continue
+			}
+			encoded, err := mimemail.EncodeText(text, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, line := range strings.Split(encoded, "\r\n") {
+				l := len(line)
+				if i == 0 {
+					l += opts.Column
+				}
+				if l > 78 || (l > 76 && encodedWordRegexp.MatchString(line)) {
+					t.Errorf("line too long: %q", line)
+				}
+			}
+			for _, word := range encodedWordRegexp.FindAllString(encoded, -1) {
+				if len(word) > 75 {
+					t.Errorf("encoded-word too long: %q", word)
+				}
+			}
+
+			// a line break that is not folding would start a new field
+			for _, line := range strings.Split(encoded, "\r\n")[1:] {
+				if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+					t.Errorf("%q: line break that does not fold: %q", text, encoded)
+				}
+			}
+			if strings.ContainsAny(strings.Replace(encoded, "\r\n", "", -1), "\r\n") {
+				t.Errorf("%q: bare CR or LF in %q", text, encoded)
+			}
+
+			unfolded := strings.Replace(encoded, "\r\n", "", -1)
+			decoded, err := mimemail.DecodeText(unfolded, defaultutf8reader)
+			if err != nil {
+				t.Error(err)
+			}
+			if decoded != text {
+				t.Errorf("%+v: expected: %q, but was: %q, encoded: %q", opts, text, decoded, encoded)
+			}
+		}
+	}
+
+	if encoded, _ := mimemail.EncodeText("Hello World", nil); encoded != "Hello World" {
+		t.Errorf("expected ASCII to stay as it is, but was: %q", encoded)
+	}
+	if _, err := mimemail.EncodeText("한국어", &mimemail.EncodeOptions{Charset: "iso-2022-jp", UTF8WriterFactory: defaultutf8writer}); err == nil {
+		t.Error("expected an error for text that iso-2022-jp can not represent")
+	}
+}
@@ -0,0 +1,139 @@
+package mimemail
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// TransferDecoder returns a reader that decodes a Content-Transfer-Encoding
+// from r, reporting problems to diag, which may be nil.
+type TransferDecoder func(r io.Reader, diag Diagnostics) io.Reader
+
+func identityDecoder(r io.Reader, diag Diagnostics) io.Reader {
+	return r
+}
+
+func quotedPrintableDecoder(r io.Reader, diag Diagnostics) io.Reader {
+	qd := NewQDecoder(r, false)
+	qd.Diagnostics = diag
+	return qd
+}
+
+func base64Decoder(r io.Reader, diag Diagnostics) io.Reader {
+	bd := NewBase64Decoder(r)
+	bd.Diagnostics = diag
+	return bd
+}
+
+func uuDecoder(r io.Reader, diag Diagnostics) io.Reader {
+	return NewUUDecoder(r)
+}
+
+// transferDecodersMu guards transferDecoders, which RegisterTransferDecoder
+// changes.
+var transferDecodersMu sync.RWMutex
+
+// transferDecoders maps normalized encoding names to their decoders.
+var transferDecoders = map[string]TransferDecoder{
+	"7bit":             identityDecoder,
+	"8bit":             identityDecoder,
+	"binary":           identityDecoder,
+	"quoted-printable": quotedPrintableDecoder,
+	"base64":           base64Decoder,
+	"x-uuencode":       uuDecoder,
+}
+
+// transferEncodingAliases maps names with their "-", "_" and spaces
+// removed to registered names, to catch aliases and misspellings.
+var transferEncodingAliases = map[string]string{
+	"7bit":            "7bit",
+	"8bit":            "8bit",
+	"binary":          "binary",
+	"quotedprintable": "quoted-printable",
+	"qp":              "quoted-printable",
+	"q":               "quoted-printable", // accepted by BodyReader before the registry
+	"base64":          "base64",
+	"b64":             "base64",
+	"b":               "base64",
+	"xuuencode":       "x-uuencode",
+	"uuencode":        "x-uuencode",
+	"xuue":            "x-uuencode",
+	"uue":             "x-uuencode",
+}
+
+// RegisterTransferDecoder makes BodyReader decode the named
+// Content-Transfer-Encoding with td. It replaces any decoder the
+// encoding had, a nil td removes it. It is safe to call while bodies
+// are decoded.
+func RegisterTransferDecoder(name string, td TransferDecoder) {
+	name = NormalizeTransferEncoding(name)
+	transferDecodersMu.Lock()
+	defer transferDecodersMu.Unlock()
+	if td == nil {
+		delete(transferDecoders, name)
+		return
+	}
+	transferDecoders[name] = td
+}
+
+func lookupTransferDecoder(name string) (td TransferDecoder, ok bool) {
+	transferDecodersMu.RLock()
+	defer transferDecodersMu.RUnlock()
+	td, ok = transferDecoders[name]
+	return
+}
+
+// NormalizeTransferEncoding cleans up a Content-Transfer-Encoding value the
+// way mailers write it, like "Base64 ", "base-64" or "\"quoted_printable\"",
+// and returns the name it is registered with. An empty value is "7bit", the
+// default of RFC 2045 section 6.1.
+func NormalizeTransferEncoding(name string) string {
+	if i := strings.IndexAny(name, ";("); i != -1 {
+		name = name[:i]
+	}
+	name = strings.ToLower(strings.Trim(name, " \t\r\n\"'"))
+	if name == "" {
+		return "7bit"
+	}
+	if _, ok := lookupTransferDecoder(name); ok {
+		return name
+	}
+	squeezed := strings.Map(func(r rune) rune {
+		switch r {
+		case '-', '_', ' ', '\t':
+			return -1
+		}
+		return r
+	}, name)
+	if alias, ok := transferEncodingAliases[squeezed]; ok {
+		return alias
+	}
+	return name
+}
+
+// UnknownTransferEncodingError is a Content-Transfer-Encoding that has no
+// registered decoder.
+type UnknownTransferEncodingError struct {
+	Encoding string
+}
+
+func (e *UnknownTransferEncodingError) Error() string {
+	return fmt.Sprintf("mail: unknown transfer encoding %q", e.Encoding)
+}
+
+// transferDecoder looks up the decoder of encoding, which is an error
+// unless opts is tolerant.
+func transferDecoder(encoding string, r io.Reader, opts *DecodeOptions) (br io.Reader, err error) {
+	td, ok := lookupTransferDecoder(NormalizeTransferEncoding(encoding))
+	if ok {
+		return td(r, opts.diagnostics()), nil
+	}
+	err = &UnknownTransferEncodingError{Encoding: encoding}
+	report(opts.diagnostics(), UnknownTransferEncoding, encoding, "", err)
+	if opts != nil && opts.Tolerant {
+		return r, nil
+	}
+	return
+}
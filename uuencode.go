@@ -0,0 +1,211 @@
+package mimemail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+)
+
+// UUDecoder decodes the first uuencoded file in its input, for the
+// x-uuencode transfer encoding. The text before the "begin" line and
+// after the "end" line is skipped.
+type UUDecoder struct {
+	r     *bufio.Reader
+	out   []byte
+	pos   int
+	err   error
+	begun bool
+
+	Name string      // From the "begin" line, set by the first Read
+	Mode os.FileMode // From the "begin" line, set by the first Read
+}
+
+func NewUUDecoder(r io.Reader) *UUDecoder {
+	return &UUDecoder{r: bufio.NewReader(r)}
+}
+
+// ErrNoUUBegin is returned by UUDecoder when there is no "begin" line.
+var ErrNoUUBegin = errors.New("mail: no uuencoded data")
+
+func (ud *UUDecoder) Read(p []byte) (n int, err error) {
+	for {
+		if ud.pos < len(ud.out) {
+			n = copy(p, ud.out[ud.pos:])
+			ud.pos += n
+			return
+		}
+		if ud.err != nil {
+			return 0, ud.err
+		}
+		ud.out, ud.pos = ud.out[:0], 0
+		ud.err = ud.readLine()
+	}
+}
+
+func (ud *UUDecoder) readLine() (err error) {
+	line, err := ud.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		if ud.begun {
+			return errors.New("mail: uuencoded line too long")
+		}
+		// a long line of the text before the "begin" line
+		for err == bufio.ErrBufferFull {
+			_, err = ud.r.ReadSlice('\n')
+		}
+		if err == io.EOF {
+			err = ErrNoUUBegin
+		}
+		return
+	}
+	if len(line) == 0 && err != nil {
+		if err == io.EOF && !ud.begun {
+			err = ErrNoUUBegin
+		}
+		return
+	}
+	err = nil
+	line = trimEOL(line)
+
+	if !ud.begun {
+		if mode, name, ok := parseUUBegin(line); ok {
+			ud.begun, ud.Mode, ud.Name = true, mode, name
+		}
+		return
+	}
+	if string(line) == "end" {
+		return io.EOF
+	}
+	var ok bool
+	if ud.out, ok = decodeUULine(ud.out, line, false); !ok {
+		return errors.New("mail: invalid uuencoded line: " + strconv.Quote(string(line)))
+	}
+	return
+}
+
+// UUFile is a file that was uuencoded in the text of a message.
+type UUFile struct {
+	Name string
+	Mode os.FileMode
+	Data []byte
+}
+
+// ExtractUUEncoded finds the uuencoded files in plain text, like the
+// "begin 644 file.zip" blocks of old mailers, and returns the text without
+// them. Blocks with lines that are not exactly uuencoded are left in the text.
+func ExtractUUEncoded(r io.Reader) (text []byte, files []*UUFile, err error) {
+	br := bufio.NewReader(r)
+	textBuf := bytes.NewBuffer(nil)
+	var block [][]byte // the lines of the current block, to put back if it is invalid
+	var file *UUFile
+
+	putBack := func() {
+		for _, l := range block {
+			textBuf.Write(l)
+		}
+		block, file = nil, nil
+	}
+
+	for {
+		var line []byte
+		line, err = br.ReadBytes('\n')
+		if len(line) > 0 {
+			content := trimEOL(line)
+			inText := file == nil
+			if file != nil {
+				var ok bool
+				if string(content) == "end" {
+					files = append(files, file)
+					block, file = nil, nil
+				} else if file.Data, ok = decodeUULine(file.Data, content, true); ok {
+					block = append(block, line)
+				} else {
+					// the line that ends a false block may begin a real one
+					putBack()
+					inText = true
+				}
+			}
+			if inText {
+				if mode, name, ok := parseUUBegin(content); ok {
+					file = &UUFile{Name: name, Mode: mode}
+					block = append(block, line)
+				} else {
+					textBuf.Write(line)
+				}
+			}
+		}
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+	}
+	putBack()
+	text = textBuf.Bytes()
+	return
+}
+
+// parseUUBegin parses a "begin 644 name" line.
+func parseUUBegin(line []byte) (mode os.FileMode, name string, ok bool) {
+	if !bytes.HasPrefix(line, []byte("begin ")) {
+		return
+	}
+	fields := bytes.SplitN(line[len("begin "):], []byte(" "), 2)
+	if len(fields) != 2 || len(fields[1]) == 0 {
+		return
+	}
+	m, err := strconv.ParseUint(string(fields[0]), 8, 32)
+	if err != nil {
+		return
+	}
+	return os.FileMode(m), string(fields[1]), true
+}
+
+// decodeUULine appends the bytes of a uuencoded line to dst. Encoders that
+// strip trailing spaces leave lines short, unless strict those are padded.
+func decodeUULine(dst []byte, line []byte, strict bool) ([]byte, bool) {
+	if len(line) == 0 {
+		// some encoders end with an empty line instead of "`"
+		return dst, true
+	}
+	n := int(line[0]-' ') & 0x3f
+	if line[0] < ' ' || line[0] > '`' {
+		return dst, false
+	}
+	chars := line[1:]
+	need := (n + 2) / 3 * 4
+	if len(chars) > need+1 || (strict && len(chars) < need) {
+		// one check character is allowed
+		return dst, false
+	}
+
+	var q [4]byte
+	for i := 0; i < need; i += 4 {
+		for j := range q {
+			q[j] = 0
+			if i+j < len(chars) {
+				c := chars[i+j]
+				if c < ' ' || c > '`' {
+					return dst, false
+				}
+				q[j] = (c - ' ') & 0x3f
+			}
+		}
+		b := [3]byte{q[0]<<2 | q[1]>>4, q[1]<<4 | q[2]>>2, q[2]<<6 | q[3]}
+		if m := n - i/4*3; m < 3 {
+			dst = append(dst, b[:m]...)
+		} else {
+			dst = append(dst, b[:]...)
+		}
+	}
+	return dst, true
+}
+
+func trimEOL(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
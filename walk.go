@@ -0,0 +1,84 @@
+package mimemail
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/textproto"
+)
+
+// WalkFunc is called by Walk for every part. body is the raw body of a
+// part that is not a multipart or a message/rfc822, it is valid until the
+// function returns; PartHeader.DecodedReader and PartHeader.UTF8Reader
+// decode it. The rest of a body that is not read is skipped. For parts
+// that have parts of their own body is nil, and those parts are walked
+// after it unless it returns SkipPart.
+type WalkFunc func(ph *PartHeader, body io.Reader) error
+
+// SkipPart is returned by a WalkFunc to skip the parts of a multipart or
+// of an enclosed message. It is not returned by Walk.
+var SkipPart = errors.New("skip this part")
+
+// Walk reads a message part by part in the order they are in it and calls
+// fn for each, stopping at the first error fn returns. Unlike Parse it
+// does not keep the bodies, so messages of any size are read with
+// bounded memory.
+func Walk(r io.Reader, fn WalkFunc) error {
+	return WalkWithOptions(r, nil, fn)
+}
+
+// WalkWithOptions is like Walk, decoding header fields and bodies with opts.
+func WalkWithOptions(r io.Reader, opts *DecodeOptions, fn WalkFunc) error {
+	return walkMessage(r, opts, 0, fn)
+}
+
+func walkMessage(r io.Reader, opts *DecodeOptions, depth int, fn WalkFunc) (err error) {
+	br := bufio.NewReader(r)
+	var header textproto.MIMEHeader
+	if header, err = readMessageHeader(br); err != nil {
+		return
+	}
+	return walkPart(header, br, "text/plain", opts, depth, fn)
+}
+
+func walkPart(header textproto.MIMEHeader, body io.Reader, defaultType string, opts *DecodeOptions, depth int, fn WalkFunc) (err error) {
+	if depth > maxPartDepth {
+		return errNestedTooDeep
+	}
+	ph := newPartHeader(header, defaultType, opts, depth)
+
+	if ph.boundary() == "" && !ph.isMessage() {
+		if err = fn(ph, body); err == SkipPart {
+			err = nil
+		}
+		return
+	}
+	if err = fn(ph, nil); err == SkipPart {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	if ph.isMessage() {
+		var r io.Reader
+		if r, err = ph.DecodedReader(body); err != nil {
+			return
+		}
+		return walkMessage(r, opts, depth+1, fn)
+	}
+	mr := newMultipartReader(body, ph.boundary())
+	for {
+		var h textproto.MIMEHeader
+		var partBody io.Reader
+		if h, partBody, err = mr.nextPart(); err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+		if err = walkPart(h, partBody, ph.childType(), opts, depth+1, fn); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package mimemail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxLineLen is the line length header folding keeps to, RFC 5322 section 2.1.1.
+	maxLineLen = 78
+	// maxEncodedLineLen is the limit of lines with encoded-words, RFC 2047 section 2.
+	maxEncodedLineLen = 76
+	// maxWordLen is the longest encoded-word RFC 2047 allows.
+	maxWordLen = 75
+)
+
+// EncodeOptions configures how header text is encoded.
+type EncodeOptions struct {
+	Charset           string            // Defaults to utf-8
+	UTF8WriterFactory UTF8WriterFactory // Encodes charsets other than utf-8, defaults to DefaultUTF8WriterFactory
+	Encoding          string            // "B" or "Q", or "" to use the shorter one for every word
+	Column            int               // Where the text starts on its line, like len("Subject: ")
+}
+
+// EncodeText encodes UTF-8 header text with RFC 2047 encoded-words where
+// they are needed, and folds it at 78 columns.
+func EncodeText(text string, opts *EncodeOptions) (encoded string, err error) {
+	b := bytes.NewBuffer(nil)
+	w := NewRFC2047Writer(b, opts)
+	if _, err = io.WriteString(w, text); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	encoded = b.String()
+	return
+}
+
+// RFC2047Writer encodes the UTF-8 header text written to it. Words that are
+// printable ASCII are written as they are, runs of other words are written as
+// encoded-words of at most 75 characters that never split a character. Words
+// are separated by spaces and tabs only, CR and LF are encoded like other
+// control characters so that they can not end the header.
+type RFC2047Writer struct {
+	w           io.Writer
+	charset     string
+	encoding    string
+	factory     UTF8WriterFactory
+	col         int
+	in          []byte
+	space       []byte // whitespace waiting for the next word
+	run         []byte // words to be written as encoded-words
+	lead        []byte // whitespace before run
+	afterWord   bool   // the last thing written was an encoded-word
+	wordOnLine  bool   // the current line has an encoded-word
+	atStart     bool
+	err         error
+	encodedText []byte
+	probe       bytes.Buffer
+}
+
+func NewRFC2047Writer(w io.Writer, opts *EncodeOptions) *RFC2047Writer {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	charset := strings.ToLower(opts.Charset)
+	if charset == "" {
+		charset = "utf-8"
+	}
+	factory := opts.UTF8WriterFactory
+	if factory == nil {
+		factory = &DefaultUTF8WriterFactory{}
+	}
+	return &RFC2047Writer{
+		w:        w,
+		charset:  charset,
+		encoding: strings.ToUpper(opts.Encoding),
+		factory:  factory,
+		col:      opts.Column,
+		atStart:  true,
+	}
+}
+
+func (rw *RFC2047Writer) Write(p []byte) (n int, err error) {
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	rw.in = append(rw.in, p...)
+
+	// Words are only complete when whitespace follows them.
+	cut := len(rw.in)
+	for cut > 0 && !isBlank(rw.in[cut-1]) {
+		cut--
+	}
+	if err = rw.encode(rw.in[:cut]); err != nil {
+		rw.err = err
+		return 0, err
+	}
+	rw.in = append(rw.in[:0], rw.in[cut:]...)
+	return len(p), nil
+}
+
+// Close encodes the rest of the text and writes the trailing whitespace.
+func (rw *RFC2047Writer) Close() (err error) {
+	if rw.err != nil {
+		return rw.err
+	}
+	if err = rw.encode(rw.in); err != nil {
+		return
+	}
+	if err = rw.flushRun(); err != nil {
+		return
+	}
+	rw.in = rw.in[:0]
+	_, err = rw.w.Write(rw.space)
+	rw.space = rw.space[:0]
+	return
+}
+
+// encode writes the words of text, keeping its trailing whitespace for the next word.
+func (rw *RFC2047Writer) encode(text []byte) (err error) {
+	for len(text) > 0 {
+		ws := 0
+		for ws < len(text) && isBlank(text[ws]) {
+			ws++
+		}
+		rw.space = append(rw.space, text[:ws]...)
+		text = text[ws:]
+
+		l := 0
+		for l < len(text) && !isBlank(text[l]) {
+			l++
+		}
+		if l == 0 {
+			return
+		}
+		if err = rw.writeWord(text[:l]); err != nil {
+			return
+		}
+		text = text[l:]
+	}
+	return
+}
+
+func (rw *RFC2047Writer) writeWord(word []byte) (err error) {
+	if !needsEncoding(word) {
+		if err = rw.flushRun(); err != nil {
+			return
+		}
+		limit := maxLineLen
+		if rw.wordOnLine {
+			limit = maxEncodedLineLen
+		}
+		// folding goes before the whitespace, so it does not change the text
+		if rw.col+len(rw.space)+len(word) > limit && len(rw.space) > 0 && !rw.atStart {
+			if err = rw.fold(""); err != nil {
+				return
+			}
+		}
+		if err = rw.writeBytes(rw.space); err != nil {
+			return
+		}
+		rw.space = rw.space[:0]
+		rw.afterWord, rw.atStart = false, false
+		return rw.writeBytes(word)
+	}
+
+	// Whitespace between two encoded-words is dropped by decoders,
+	// so it is encoded into the run.
+	if len(rw.run) > 0 || rw.afterWord {
+		rw.run = append(rw.run, rw.space...)
+	} else {
+		rw.lead = append(rw.lead[:0], rw.space...)
+	}
+	rw.space = rw.space[:0]
+	rw.run = append(rw.run, word...)
+
+	if len(rw.run) > maxRunLen {
+		return rw.flushRun()
+	}
+	return
+}
+
+// maxRunLen bounds how much text RFC2047Writer collects before it
+// writes it as encoded-words.
+const maxRunLen = 1024
+
+// flushRun writes the collected run of words that need encoding as
+// encoded-words, folding between them.
+func (rw *RFC2047Writer) flushRun() (err error) {
+	if len(rw.run) == 0 {
+		return
+	}
+	// Make the first word fit on the current line, unless that would make
+	// it too short to be worth it and the line can be folded instead.
+	first := maxEncodedLineLen - rw.col - 1
+	if !rw.afterWord {
+		first = maxEncodedLineLen - rw.col - len(rw.lead)
+	}
+	fold := false
+	if first < maxWordLen/2 && !rw.atStart {
+		if !rw.afterWord && len(rw.lead) > 0 {
+			// the fold goes before the lead, which stays on the new line
+			fold, first = true, maxEncodedLineLen-len(rw.lead)
+		} else {
+			first = maxWordLen
+		}
+	}
+	if first > maxWordLen {
+		first = maxWordLen
+	}
+
+	var words [][]byte
+	if words, err = rw.encodedWords(rw.run, first); err != nil {
+		return
+	}
+	rw.run = rw.run[:0]
+
+	for i, ew := range words {
+		if i == 0 && !rw.afterWord {
+			if fold {
+				if err = rw.fold(""); err != nil {
+					return
+				}
+			}
+			if err = rw.writeBytes(rw.lead); err != nil {
+				return
+			}
+			rw.lead = rw.lead[:0]
+		} else if rw.col+1+len(ew) > maxEncodedLineLen {
+			if err = rw.fold(" "); err != nil {
+				return
+			}
+		} else if err = rw.writeString(" "); err != nil {
+			return
+		}
+		if err = rw.writeBytes(ew); err != nil {
+			return
+		}
+		rw.afterWord, rw.atStart, rw.wordOnLine = true, false, true
+	}
+	return
+}
+
+// encodedWords splits text into encoded-words of at most maxWordLen
+// characters, the first one at most first, on character boundaries.
+func (rw *RFC2047Writer) encodedWords(text []byte, first int) (words [][]byte, err error) {
+	max := first
+	for len(text) > 0 {
+		var ew []byte
+		var n int
+		if ew, n, err = rw.encodedWord(text, max); err != nil {
+			return
+		}
+		words = append(words, ew)
+		text = text[n:]
+		max = maxWordLen
+	}
+	return
+}
+
+// encodedWord encodes as many characters of text as fit in an encoded-word
+// of max characters, at least one, and returns how many bytes of text it
+// encoded. Each character is encoded once, keeping the length of the word
+// as it grows.
+func (rw *RFC2047Writer) encodedWord(text []byte, max int) (ew []byte, n int, err error) {
+	if rw.charset == "utf-8" {
+		var wl wordLen
+		for n < len(text) {
+			_, size := utf8.DecodeRune(text[n:])
+			wl.add(text[n : n+size])
+			if n > 0 && rw.wordLen(wl) > max {
+				break
+			}
+			n += size
+		}
+		return rw.appendWord(text[:n]), n, nil
+	}
+
+	rw.probe.Reset()
+	var wc io.WriteCloser
+	if wc, err = rw.charsetWriter(&rw.probe); err != nil {
+		return
+	}
+	var wl wordLen
+	for n < len(text) {
+		_, size := utf8.DecodeRune(text[n:])
+		before := rw.probe.Len()
+		if _, err = wc.Write(text[n : n+size]); err != nil {
+			return
+		}
+		wl.add(rw.probe.Bytes()[before:])
+		if n > 0 && rw.wordLen(wl) > max {
+			break
+		}
+		n += size
+	}
+
+	// a charset with shift states, like ISO-2022-JP, writes the way back to
+	// its initial state when it is closed, which may not fit any more
+	for {
+		var b []byte
+		if b, err = rw.encodeCharset(text[:n]); err != nil {
+			return
+		}
+		wl = wordLen{}
+		wl.add(b)
+		_, size := utf8.DecodeLastRune(text[:n])
+		if rw.wordLen(wl) <= max || size == n {
+			return rw.appendWord(b), n, nil
+		}
+		n -= size
+	}
+}
+
+// wordLen is the length of the text of an encoded-word as bytes are added.
+type wordLen struct {
+	b int // bytes
+	q int // their "Q" encoding
+}
+
+func (wl *wordLen) add(b []byte) {
+	wl.b += len(b)
+	for _, c := range b {
+		if c == ' ' || isQWordSafe(c) {
+			wl.q++
+		} else {
+			wl.q += 3
+		}
+	}
+}
+
+// wordLen returns the length of the encoded-word of wl in the encoding
+// appendWord picks.
+func (rw *RFC2047Writer) wordLen(wl wordLen) int {
+	l := len("=?") + len(rw.charset) + len("?B?") + len("?=")
+	b := (wl.b + 2) / 3 * 4
+	switch rw.encoding {
+	case "B":
+		return l + b
+	case "Q":
+		return l + wl.q
+	}
+	if b < wl.q {
+		return l + b
+	}
+	return l + wl.q
+}
+
+func (rw *RFC2047Writer) charsetWriter(w io.Writer) (wc io.WriteCloser, err error) {
+	if wc, err = rw.factory.UTF8Writer(rw.charset, w); err != nil {
+		return
+	}
+	if encoder, ok := wc.(*EncoderWriter); ok {
+		encoder.Policy = FailOnUnencodable
+	}
+	return
+}
+
+// encodeCharset encodes text into the charset of the words.
+func (rw *RFC2047Writer) encodeCharset(text []byte) (b []byte, err error) {
+	buf := bytes.NewBuffer(rw.encodedText[:0])
+	var wc io.WriteCloser
+	if wc, err = rw.charsetWriter(buf); err != nil {
+		return
+	}
+	if _, err = wc.Write(text); err != nil {
+		return
+	}
+	if err = wc.Close(); err != nil {
+		return
+	}
+	rw.encodedText = buf.Bytes()
+	return rw.encodedText, nil
+}
+
+// appendWord returns b, in the charset of the words, as an encoded-word.
+func (rw *RFC2047Writer) appendWord(b []byte) []byte {
+	prefix := "=?" + rw.charset + "?"
+	switch rw.encoding {
+	case "B":
+		return appendBWord([]byte(prefix), b)
+	case "Q":
+		return appendQWord([]byte(prefix), b)
+	}
+	bw := appendBWord([]byte(prefix), b)
+	qw := appendQWord([]byte(prefix), b)
+	if len(bw) < len(qw) {
+		return bw
+	}
+	return qw
+}
+
+func appendBWord(dst []byte, b []byte) []byte {
+	dst = append(dst, "B?"...)
+	dst = append(dst, base64.StdEncoding.EncodeToString(b)...)
+	return append(dst, "?="...)
+}
+
+func appendQWord(dst []byte, b []byte) []byte {
+	dst = append(dst, "Q?"...)
+	for _, c := range b {
+		dst = appendQByte(dst, c)
+	}
+	return append(dst, "?="...)
+}
+
+// isQWordSafe reports whether c can appear as itself in a "Q" encoded-word
+// anywhere in a header, RFC 2047 section 5 (3).
+func isQWordSafe(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+		c == '!' || c == '*' || c == '+' || c == '-' || c == '/'
+}
+
+// isBlank reports whether c separates words, CR and LF do not.
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// needsEncoding reports whether word can not be written as it is.
+func needsEncoding(word []byte) bool {
+	if bytes.HasPrefix(word, encodedWordStart) {
+		return true
+	}
+	for _, c := range word {
+		if !isVchar(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rw *RFC2047Writer) writeBytes(b []byte) (err error) {
+	if len(b) == 0 {
+		return
+	}
+	_, err = rw.w.Write(b)
+	rw.col += len(b)
+	return
+}
+
+func (rw *RFC2047Writer) writeString(s string) error {
+	return rw.writeBytes([]byte(s))
+}
+
+// fold starts a new line with indent.
+func (rw *RFC2047Writer) fold(indent string) (err error) {
+	if _, err = io.WriteString(rw.w, "\r\n"+indent); err != nil {
+		return
+	}
+	rw.col, rw.wordOnLine = len(indent), false
+	return
+}